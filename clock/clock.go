@@ -0,0 +1,78 @@
+package clock
+
+import "time"
+
+// Clock is the source of time of the timer, queue and cron packages.
+type Clock interface {
+	// Now returns the current wall clock time.
+	Now() time.Time
+
+	// Millis returns a monotonic timestamp in milliseconds. It is unaffected
+	// by changes of the wall clock and only meaningful relative to other
+	// values returned by the same Clock.
+	Millis() int64
+
+	// Nanos returns a monotonic timestamp in nanoseconds, with the same
+	// origin as Millis.
+	Nanos() int64
+
+	// NewTimer creates a Timer that sends the current time on its channel
+	// after at least duration d.
+	NewTimer(d time.Duration) Timer
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel. The underlying Timer is not released until it
+	// fires; use NewTimer if it may need to be stopped.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a single event created by a Clock, like time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing. It returns false if the timer has
+	// already expired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d. It returns true if
+	// the timer had been active. As with time.Timer, it should only be
+	// called on stopped or expired timers with drained channels.
+	Reset(d time.Duration) bool
+}
+
+// System is the Clock backed by the operating system's clocks.
+var System Clock = systemClock{}
+
+// epoch is the origin of the monotonic timestamps of System.
+var epoch = time.Now()
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Millis() int64 {
+	return int64(time.Since(epoch) / time.Millisecond)
+}
+
+func (systemClock) Nanos() int64 {
+	return int64(time.Since(epoch))
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,154 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock is a Clock whose time only moves when Advance is called, which
+// makes tests of timers and schedules deterministic: days of activity can be
+// simulated in milliseconds.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	start  time.Time
+	now    time.Time
+	timers []*fakeTimer // waiting timers, sorted by deadline
+}
+
+// NewFake returns a FakeClock set to the given time.
+func NewFake(now time.Time) *FakeClock {
+	c := &FakeClock{
+		start: now,
+		now:   now,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Millis() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(c.now.Sub(c.start) / time.Millisecond)
+}
+
+func (c *FakeClock) Nanos() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(c.now.Sub(c.start))
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		c:     make(chan time.Time, 1),
+		clock: c,
+	}
+	t.Reset(d)
+	return t
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d. Every timer due by then fires, in
+// order of deadline, with the clock set to the timer's deadline.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].deadline.After(target) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.deadline.After(c.now) {
+			c.now = t.deadline
+		}
+		t.fire(c.now)
+	}
+	c.now = target
+}
+
+// BlockUntil blocks until at least n timers are waiting on the clock. Tests
+// use it to wait for the goroutines under test to be idle before calling
+// Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// Waiters returns the number of timers waiting on the clock.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// schedule adds t to the waiting timers, or fires it at once if it is due.
+// It must be called with mu held.
+func (c *FakeClock) schedule(t *fakeTimer) {
+	if !t.deadline.After(c.now) {
+		t.fire(c.now)
+		return
+	}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].deadline.After(t.deadline)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	c.cond.Broadcast()
+}
+
+// unschedule removes t from the waiting timers and reports whether it was
+// waiting. It must be called with mu held.
+func (c *FakeClock) unschedule(t *fakeTimer) bool {
+	for i, w := range c.timers {
+		if w == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	deadline time.Time
+	clock    *FakeClock
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.unschedule(t)
+	t.deadline = t.clock.now.Add(d)
+	t.clock.schedule(t)
+	return active
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_Advance(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	t1 := c.NewTimer(2 * time.Second)
+	t2 := c.NewTimer(time.Second)
+	t3 := c.NewTimer(3 * time.Second)
+	if c.Waiters() != 3 {
+		t.Fatalf("expected 3 waiting timers, got %d", c.Waiters())
+	}
+
+	c.Advance(2500 * time.Millisecond)
+	for i, timer := range []Timer{t2, t1} {
+		select {
+		case fired := <-timer.C():
+			if expected := start.Add(time.Duration(i+1) * time.Second); !fired.Equal(expected) {
+				t.Errorf("expected timer to fire at %v, got %v", expected, fired)
+			}
+		default:
+			t.Fatalf("expected timer %d to fire", i)
+		}
+	}
+	select {
+	case <-t3.C():
+		t.Fatal("expected timer not to fire before its deadline")
+	default:
+	}
+	if c.Millis() != 2500 || c.Nanos() != int64(2500*time.Millisecond) || !c.Now().Equal(start.Add(2500*time.Millisecond)) {
+		t.Errorf("expected clock at 2500ms, got %dms", c.Millis())
+	}
+
+	if !t3.Stop() || t3.Stop() {
+		t.Error("expected only the first Stop of a waiting timer to return true")
+	}
+	c.Advance(time.Hour)
+	select {
+	case <-t3.C():
+		t.Fatal("expected stopped timer not to fire")
+	default:
+	}
+
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("expected a timer with no duration to fire at once")
+	}
+}
+
+func TestFakeClock_BlockUntil(t *testing.T) {
+	c := NewFake(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		<-c.After(time.Minute)
+		close(done)
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting goroutine to be woken up")
+	}
+}
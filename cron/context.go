@@ -0,0 +1,117 @@
+package cron
+
+import (
+	"context"
+	"time"
+)
+
+// ContextJob is a Job whose Run observes cancellation. The context given to
+// Run is cancelled when the entry is removed or the Cron is stopped, and
+// carries the JobInfo of the run.
+type ContextJob interface {
+	Run(ctx context.Context)
+}
+
+// ContextFuncJob is a wrapper that turns a func(context.Context) into a
+// cron.ContextJob
+type ContextFuncJob func(ctx context.Context)
+
+func (f ContextFuncJob) Run(ctx context.Context) { f(ctx) }
+
+// JobInfo describes the run of a ContextJob.
+type JobInfo struct {
+	// ID is the ID of the entry running the job.
+	ID EntryID
+	// Scheduled is the activation time of the run, in the location of the
+	// Cron. A run delayed by DelayIfStillRunning sees the latest activation.
+	Scheduled time.Time
+}
+
+type jobInfoKey struct{}
+
+// JobInfoFrom returns the JobInfo carried by the context of a ContextJob.
+func JobInfoFrom(ctx context.Context) (JobInfo, bool) {
+	info, ok := ctx.Value(jobInfoKey{}).(JobInfo)
+	return info, ok
+}
+
+// AddContextFunc adds a func to the Cron to be run on the given schedule,
+// like AddFunc, with the context of the run.
+func (c *Cron) AddContextFunc(spec string, cmd func(ctx context.Context)) (EntryID, error) {
+	return c.AddContextJob(spec, ContextFuncJob(cmd))
+}
+
+// AddContextJob adds a ContextJob to the Cron to be run on the given
+// schedule, like AddJob.
+func (c *Cron) AddContextJob(spec string, cmd ContextJob) (EntryID, error) {
+	schedule, err := c.parser.Parse(spec)
+	if err != nil {
+		return 0, err
+	}
+	return c.ScheduleContext(schedule, cmd), nil
+}
+
+// ScheduleContext adds a ContextJob to the Cron to be run on the given
+// schedule, like Schedule. The job is adapted to a Job, which is wrapped with
+// the configured Chain and is the Job of the entry.
+func (c *Cron) ScheduleContext(schedule Schedule, cmd ContextJob) EntryID {
+	job := &contextJob{job: cmd}
+	return c.schedule(schedule, job, job)
+}
+
+// WithoutContext adapts a Job to the ContextJob interface. Its Run ignores
+// the context.
+func WithoutContext(job Job) ContextJob {
+	return ContextFuncJob(func(context.Context) { job.Run() })
+}
+
+// contextJob adapts a ContextJob to the Job interface, running it with the
+// context of its entry.
+type contextJob struct {
+	job   ContextJob
+	entry *entry
+}
+
+func (j *contextJob) Run() {
+	j.job.Run(j.entry.context())
+}
+
+// context returns the context of the current run of the entry. Its parent
+// is cancelled by Stop, and it is cancelled by Remove.
+func (e *entry) context() context.Context {
+	parent := e.cron.runContext()
+	e.tmu.Lock()
+	defer e.tmu.Unlock()
+	if e.ctx == nil || (e.ctx.Err() != nil && !e.removed) {
+		// First run, or first run since the Cron was started again.
+		e.ctx, e.cancel = context.WithCancel(parent)
+		if e.removed {
+			e.cancel()
+		}
+	}
+	return context.WithValue(e.ctx, jobInfoKey{}, JobInfo{ID: e.ID, Scheduled: e.Prev})
+}
+
+// remove cancels the context of the running job, if any, and of the runs to
+// come.
+func (e *entry) remove() {
+	e.tmu.Lock()
+	defer e.tmu.Unlock()
+	e.removed = true
+	if e.cancel != nil {
+		e.cancel()
+	}
+}
+
+// runContext returns the context cancelled by Stop, or a cancelled context
+// if the Cron is not running.
+func (c *Cron) runContext() context.Context {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	if c.running {
+		return c.runCtx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
@@ -2,23 +2,33 @@ package cron
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/GuoCeng/time-wheel/clock"
+	"github.com/GuoCeng/time-wheel/logging"
 	"github.com/GuoCeng/time-wheel/timer"
 )
 
 type Cron struct {
-	entries   map[EntryID]*Entry
-	chain     Chain
-	stop      chan struct{}
-	cycle     chan *Entry
-	running   bool
-	runningMu sync.Mutex
-	parser    ScheduleParser
-	nextID    *EntryID
-	timer     timer.Timer
+	entries     map[EntryID]*entry
+	chain       Chain
+	cancel      context.CancelFunc
+	runCtx      context.Context // cancelled by Stop, parent of the contexts of ContextJobs
+	cycle       chan *Entry
+	running     bool
+	runningMu   sync.Mutex
+	lifecycleMu sync.Mutex // serializes Start, Run and Stop
+	jobWaiter   sync.WaitGroup
+	parser      ScheduleParser
+	nextID      *EntryID
+	timer       timer.Timer
+	ownTimer    bool
+	executor    timer.Executor
+	location    *time.Location
+	clock       clock.Clock
 }
 
 // Schedule describes a job's duty cycle.
@@ -38,39 +48,73 @@ type Job interface {
 
 type EntryID = int64
 
+// Entry consists of a schedule and the func to execute on that schedule.
+// Entries returned by Cron are snapshots; changing them has no effect.
 type Entry struct {
-	tmu        sync.RWMutex
-	emu        sync.RWMutex
-	ID         EntryID
-	Schedule   Schedule
-	delayMs    int64
-	Next       time.Time
-	Prev       time.Time
+	// ID is the cron-assigned ID of this entry, which may be used to look up a
+	// snapshot or remove it.
+	ID EntryID
+
+	// Schedule on which this job should be run.
+	Schedule Schedule
+
+	// Next time the job will run, or the zero time if Cron has not been
+	// started or this entry's schedule is unsatisfiable
+	Next time.Time
+
+	// Prev is the last time this job was run, or the zero time if never.
+	Prev time.Time
+
+	// WrappedJob is the thing to run when the Schedule is activated.
 	WrappedJob Job
-	Job        Job
-	taskEntry  *timer.TaskEntry
-	cron       *Cron
+
+	// Job is the thing that was submitted to cron.
+	// It is kept around so that user code that needs to get at the job later,
+	// e.g. via Entries() can do so.
+	Job Job
 }
 
 // Valid returns true if this is not the zero entry.
-func (e *Entry) Valid() bool { return e.GetID() != 0 }
+func (e Entry) Valid() bool { return e.ID != 0 }
 
-func (t *Entry) GetID() int64 {
-	return t.ID
+// entry is the timer.Task that drives an Entry on the cron's timing wheel.
+type entry struct {
+	tmu sync.RWMutex
+	emu sync.RWMutex
+	Entry
+	delay     int64
+	taskEntry *timer.TaskEntry
+	cron      *Cron
+	ctx       context.Context // context of the ContextJob, guarded by tmu
+	cancel    context.CancelFunc
+	removed   bool
 }
 
-func (e *Entry) GetDelay() int64 {
-	e.tmu.RLock()
-	defer e.tmu.RUnlock()
-	now := time.Now()
-	t := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.Local)
-	next := e.Schedule.Next(t)
-	e.Prev = e.Next
-	e.Next = next
-	e.delayMs = next.Sub(t).Milliseconds()
-	return e.delayMs
+func (e *entry) GetID() int64 {
+	return e.ID
+}
+
+// GetDelay returns the time until Next, in the unit of the cron's timer. If
+// Next has already passed, e.g. because the previous run took longer than the
+// schedule's period, the next activation is recomputed from now.
+func (e *entry) GetDelay() int64 {
+	e.tmu.Lock()
+	defer e.tmu.Unlock()
+	t := e.cron.now()
+	if !e.Next.After(t) {
+		e.Next = e.Schedule.Next(t)
+	}
+	// Round up so that the job never runs before Next.
+	u := e.cron.timer.Unit()
+	d := e.Next.Sub(t)
+	e.delay = u.ConvertDuration(d)
+	if u.ToDuration(e.delay) < d {
+		e.delay++
+	}
+	return e.delay
 }
-func (e *Entry) Cancel() {
+
+func (e *entry) Cancel() {
 	e.emu.Lock()
 	defer e.emu.Unlock()
 	if e.taskEntry != nil {
@@ -79,7 +123,7 @@ func (e *Entry) Cancel() {
 	e.taskEntry = nil
 }
 
-func (e *Entry) SetTaskEntry(entry *timer.TaskEntry) {
+func (e *entry) SetTaskEntry(entry *timer.TaskEntry) {
 	e.emu.Lock()
 	defer e.emu.Unlock()
 	if e.taskEntry != nil && e.taskEntry != entry {
@@ -87,32 +131,86 @@ func (e *Entry) SetTaskEntry(entry *timer.TaskEntry) {
 	}
 	e.taskEntry = entry
 }
-func (e *Entry) GetTaskEntry() *timer.TaskEntry {
+
+func (e *entry) GetTaskEntry() *timer.TaskEntry {
 	e.emu.RLock()
 	defer e.emu.RUnlock()
 	return e.taskEntry
 }
 
-func (e *Entry) Run() {
+// Run records the activation, runs the job and puts the entry back on the
+// timer for its next activation, if any.
+func (e *entry) Run() {
+	if !e.cron.contains(e) {
+		// Removed before it was put on the timer.
+		return
+	}
+	if !e.cron.startJob() {
+		// The cron was stopped while the task was being dispatched; keep the
+		// entry on the timer so that it resumes if the cron is started again.
+		if e.cron.contains(e) {
+			e.cron.add(e)
+		}
+		return
+	}
+	defer e.cron.jobWaiter.Done()
+	e.tmu.Lock()
+	e.Prev = e.Next
+	e.Next = e.Schedule.Next(e.Prev)
+	next := e.Next
+	e.tmu.Unlock()
 	e.WrappedJob.Run()
-	e.cron.timer.Add(e)
+	if !next.IsZero() && e.cron.contains(e) {
+		e.cron.add(e)
+	}
+}
+
+// snapshot returns a copy of the public part of the entry.
+func (e *entry) snapshot() Entry {
+	e.tmu.RLock()
+	defer e.tmu.RUnlock()
+	return e.Entry
+}
+
+// byTime is a wrapper for sorting the entry array by time
+// (with zero time at the end).
+type byTime []Entry
+
+func (s byTime) Len() int      { return len(s) }
+func (s byTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byTime) Less(i, j int) bool {
+	// Two zero times should return false.
+	// Otherwise, zero is "greater" than any other time.
+	// (To sort it at the end of the list.)
+	if s[i].Next.IsZero() {
+		return false
+	}
+	if s[j].Next.IsZero() {
+		return true
+	}
+	return s[i].Next.Before(s[j].Next)
 }
 
 func New(opts ...Option) *Cron {
 	c := &Cron{
-		entries:   make(map[EntryID]*Entry),
+		entries:   make(map[EntryID]*entry),
 		chain:     NewChain(),
-		stop:      make(chan struct{}),
 		running:   false,
 		cycle:     make(chan *Entry),
 		runningMu: sync.Mutex{},
 		parser:    standardParser,
 		nextID:    new(EntryID),
-		timer:     timer.NewSystemTimer(1000, 60),
+		executor:  timer.GoExecutor{},
+		location:  time.Local,
+		clock:     clock.System,
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.timer == nil {
+		c.timer = timer.NewSystemTimer(timer.WithTickMs(1000), timer.WithWheelSize(60), timer.WithExecutor(c.executor), timer.WithClock(c.clock))
+		c.ownTimer = true
+	}
 	return c
 }
 
@@ -142,80 +240,168 @@ func (c *Cron) AddJob(spec string, cmd Job) (EntryID, error) {
 // Schedule adds a Job to the Cron to be run on the given schedule.
 // The job is wrapped with the configured Chain.
 func (c *Cron) Schedule(schedule Schedule, cmd Job) EntryID {
+	return c.schedule(schedule, cmd, nil)
+}
+
+// schedule adds an entry running cmd. If bind is not nil, it is the
+// ContextJob adapter of cmd and is bound to the new entry.
+func (c *Cron) schedule(schedule Schedule, cmd Job, bind *contextJob) EntryID {
 	c.runningMu.Lock()
-	defer c.runningMu.Unlock()
 	nextID := atomic.AddInt64(c.nextID, 1)
-	entry := &Entry{
-		ID:         nextID,
-		Schedule:   schedule,
-		WrappedJob: c.chain.Then(cmd),
-		Job:        cmd,
-		cron:       c,
+	entry := &entry{
+		Entry: Entry{
+			ID:         nextID,
+			Schedule:   schedule,
+			WrappedJob: c.chain.Then(cmd),
+			Job:        cmd,
+		},
+		cron: c,
 	}
+	if bind != nil {
+		bind.entry = entry
+	}
+	entry.Next = schedule.Next(c.now())
 	c.entries[nextID] = entry
-	c.timer.Add(entry)
+	c.runningMu.Unlock()
+	if !entry.Next.IsZero() {
+		c.add(entry)
+	}
 	return entry.ID
 }
 
-// Entry returns a snapshot of the given entry, or nil if it couldn't be found.
-func (c *Cron) Entry(id EntryID) *Entry {
+// add puts the entry on the timer. It must be called without runningMu held:
+// an entry that is already due may run inside Add, e.g. with a
+// timer.SyncExecutor, and its job takes runningMu.
+func (c *Cron) add(e *entry) {
+	if err := c.timer.Add(e); err != nil {
+		logging.DefaultLogger.Error(err, "failed to schedule entry", "entry", e.ID)
+	}
+}
+
+// Entries returns a snapshot of the cron entries, sorted by their next
+// activation time.
+func (c *Cron) Entries() []Entry {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	entries := make([]Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e.snapshot())
+	}
+	sort.Sort(byTime(entries))
+	return entries
+}
+
+// Entry returns a snapshot of the given entry, or the zero Entry if it
+// couldn't be found.
+func (c *Cron) Entry(id EntryID) Entry {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
 	if e, ok := c.entries[id]; ok {
-		return e
+		return e.snapshot()
 	}
-	return &Entry{}
+	return Entry{}
+}
+
+// contains reports whether the entry is still scheduled, i.e. it has not
+// been removed while its job was running.
+func (c *Cron) contains(e *entry) bool {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	return c.entries[e.ID] == e
 }
 
 // Remove an entry from being run in the future.
 func (c *Cron) Remove(id EntryID) {
 	c.runningMu.Lock()
 	defer c.runningMu.Unlock()
-	c.Entry(id).Cancel()
-	delete(c.entries, id)
+	if e, ok := c.entries[id]; ok {
+		e.Cancel()
+		e.remove()
+		delete(c.entries, id)
+	}
 }
 
 // Start the cron scheduler in its own goroutine, or no-op if already started.
 func (c *Cron) Start() {
-	c.runningMu.Lock()
-	defer c.runningMu.Unlock()
-	if c.running {
-		return
-	}
-	c.running = true
-	go c.run()
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+	c.start()
 }
 
-// Run the cron scheduler, or no-op if already running.
+// Run the cron scheduler, or no-op if already running. Run blocks until Stop
+// is called.
 func (c *Cron) Run() {
+	c.lifecycleMu.Lock()
+	ctx := c.start()
+	c.lifecycleMu.Unlock()
+	if ctx != nil {
+		<-ctx.Done()
+	}
+}
+
+// start marks the cron as running and starts the reaper of its timer. It
+// returns a context cancelled by Stop, or nil if the cron was already
+// running. It must be called with lifecycleMu held.
+func (c *Cron) start() context.Context {
 	c.runningMu.Lock()
 	if c.running {
 		c.runningMu.Unlock()
-		return
+		return nil
 	}
 	c.running = true
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	c.runCtx = ctx
 	c.runningMu.Unlock()
-	c.run()
+	// The timer's reaper goroutine advances the clock; a timer shared with
+	// other crons may already be running, in which case this is a no-op.
+	c.timer.Start()
+	return ctx
 }
 
-// run the scheduler.. this is private just due to the need to synchronize
-// access to the 'running' state variable.
-func (c *Cron) run() {
-	for c.running {
-		ctx, _ := context.WithTimeout(context.Background(), 200*time.Millisecond)
-		c.timer.AdvanceClock(ctx)
+// startJob registers a job that is about to run with the job waiter, or
+// returns false if the cron is not running.
+func (c *Cron) startJob() bool {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	if !c.running {
+		return false
 	}
+	c.jobWaiter.Add(1)
+	return true
 }
 
 // now returns current time in c location
 func (c *Cron) now() time.Time {
-	return time.Now()
+	return c.clock.Now().In(c.location)
+}
+
+// Location gets the time zone location
+func (c *Cron) Location() *time.Location {
+	return c.location
 }
 
 // Stop stops the cron scheduler if it is running; otherwise it does nothing.
 // A context is returned so the caller can wait for running jobs to complete.
-func (c *Cron) Stop() {
+func (c *Cron) Stop() context.Context {
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
 	c.runningMu.Lock()
-	defer c.runningMu.Unlock()
+	wasRunning := c.running
 	if c.running {
 		c.running = false
+		c.cancel()
+	}
+	c.runningMu.Unlock()
+	// Stop the reaper outside of runningMu, jobs about to start take it.
+	// A timer given with WithTimer may be shared, so it is left running.
+	if wasRunning && c.ownTimer {
+		c.timer.Stop()
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c.jobWaiter.Wait()
+		cancel()
+	}()
+	return ctx
 }
@@ -2,17 +2,18 @@ package cron
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
-	_ "net/http/pprof"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/GuoCeng/time-wheel/clock"
 	"github.com/GuoCeng/time-wheel/logging"
+	"github.com/GuoCeng/time-wheel/timer"
 )
 
 // Many tests schedule a job for every second, and then wait at most a second
@@ -44,19 +45,16 @@ func newBufLogger(sw *syncWriter) logging.Logger {
 
 func TestFuncPanicRecovery(t *testing.T) {
 	var buf syncWriter
-	cron := New(WithChain(Recover(newBufLogger(&buf))))
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), WithChain(Recover(newBufLogger(&buf))))
 	cron.Start()
 	defer cron.Stop()
 	cron.AddFunc("* * * * * ?", func() {
 		panic("YOLO")
 	})
 
-	select {
-	case <-time.After(OneSecond):
-		if !strings.Contains(buf.String(), "YOLO") {
-			t.Error("expected a panic to be logged, got none")
-		}
-		return
+	advanceFake(clk, time.Second, 1)
+	if !strings.Contains(buf.String(), "YOLO") {
+		t.Error("expected a panic to be logged, got none")
 	}
 }
 
@@ -70,17 +68,14 @@ func TestJobPanicRecovery(t *testing.T) {
 	var job DummyJob
 
 	var buf syncWriter
-	cron := New(WithChain(Recover(newBufLogger(&buf))))
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), WithChain(Recover(newBufLogger(&buf))))
 	cron.Start()
 	defer cron.Stop()
 	cron.AddJob("* * * * * ?", job)
 
-	select {
-	case <-time.After(OneSecond):
-		if !strings.Contains(buf.String(), "YOLO") {
-			t.Error("expected a panic to be logged, got none")
-		}
-		return
+	advanceFake(clk, time.Second, 1)
+	if !strings.Contains(buf.String(), "YOLO") {
+		t.Error("expected a panic to be logged, got none")
 	}
 }
 
@@ -98,67 +93,58 @@ func TestNoEntries(t *testing.T) {
 
 // Start, stop, then add an entry. Verify entry doesn't run.
 func TestStopCausesJobsToNotRun(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	cron := newWithSeconds()
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
 	cron.Start()
 	cron.Stop()
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 
-	select {
-	case <-time.After(OneSecond):
-		// No job ran!
-	case <-wait(wg):
-		t.Fatal("expected stopped cron does not run any job")
+	// The reaper is stopped, so nothing waits on the clock.
+	clk.Advance(time.Second)
+	if n := atomic.LoadInt64(&calls); n != 0 {
+		t.Fatalf("expected stopped cron does not run any job, got %d runs", n)
 	}
 }
 
 // Add a job, start cron, expect it runs.
 func TestAddBeforeRunning(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	cron := newWithSeconds()
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 	cron.Start()
 	defer cron.Stop()
 
-	// Give cron 2 seconds to run our job (which is always activated).
-	select {
-	case <-time.After(OneSecond):
-		t.Fatal("expected job runs")
-	case <-wait(wg):
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("expected job runs once, got %d", n)
 	}
 }
 
 // Start cron, add a job, expect it runs.
 func TestAddWhileRunning(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	cron := newWithSeconds()
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
 	cron.Start()
 	defer cron.Stop()
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 
-	select {
-	case <-time.After(OneSecond):
-		t.Fatal("expected job runs")
-	case <-wait(wg):
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("expected job runs once, got %d", n)
 	}
 }
 
 // Test for #34. Adding a job after calling start results in multiple job invocations
 func TestAddWhileRunningWithDelay(t *testing.T) {
-	cron := newWithSeconds()
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
 	cron.Start()
 	defer cron.Stop()
-	time.Sleep(5 * time.Second)
+	// Without entries the reaper does not wait on the clock.
+	clk.Advance(5 * time.Second)
 	var calls int64
 	cron.AddFunc("* * * * * *", func() { atomic.AddInt64(&calls, 1) })
 
-	<-time.After(OneSecond)
+	advanceFake(clk, time.Second, 1)
 	if atomic.LoadInt64(&calls) != 1 {
 		t.Errorf("called %d times, expected 1\n", calls)
 	}
@@ -166,38 +152,34 @@ func TestAddWhileRunningWithDelay(t *testing.T) {
 
 // Add a job, remove a job, start cron, expect nothing runs.
 func TestRemoveBeforeRunning(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	cron := newWithSeconds()
-	id, _ := cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	// Keeps the reaper waiting on the clock.
+	cron.AddFunc("0 0 0 1 1 ?", func() {})
+	id, _ := cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 	cron.Remove(id)
 	cron.Start()
 	defer cron.Stop()
 
-	select {
-	case <-time.After(OneSecond):
-		// Success, shouldn't run
-	case <-wait(wg):
-		t.FailNow()
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 0 {
+		t.Fatalf("expected removed job does not run, got %d runs", n)
 	}
 }
 
 // Start cron, add a job, remove it, expect it doesn't run.
 func TestRemoveWhileRunning(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	cron := newWithSeconds()
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cron.AddFunc("0 0 0 1 1 ?", func() {})
 	cron.Start()
 	defer cron.Stop()
-	id, _ := cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	id, _ := cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 	cron.Remove(id)
 
-	select {
-	case <-time.After(OneSecond):
-	case <-wait(wg):
-		t.FailNow()
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 0 {
+		t.Fatalf("expected removed job does not run, got %d runs", n)
 	}
 }
 
@@ -206,96 +188,746 @@ func TestRemoveWhileRunning(t *testing.T) {
 // that the immediate entry runs immediately.
 // Also: Test that multiple jobs run in the same instant.
 func TestMultipleEntries(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-
-	cron := newWithSeconds()
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
 	cron.AddFunc("0 0 0 1 1 ?", func() {})
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
-	id1, _ := cron.AddFunc("* * * * * ?", func() { t.Fatal() })
-	id2, _ := cron.AddFunc("* * * * * ?", func() { t.Fatal() })
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
+	id1, _ := cron.AddFunc("* * * * * ?", func() { t.Error("expected removed job does not run") })
+	id2, _ := cron.AddFunc("* * * * * ?", func() { t.Error("expected removed job does not run") })
 	cron.AddFunc("0 0 0 31 12 ?", func() {})
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 
 	cron.Remove(id1)
 	cron.Start()
 	cron.Remove(id2)
 	defer cron.Stop()
 
-	select {
-	case <-time.After(OneSecond):
-		t.Error("expected job run in proper order")
-	case <-wait(wg):
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("expected both jobs run in the same instant, got %d runs", n)
 	}
 }
 
 // Test running the same job twice.
 func TestRunningJobTwice(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-
-	cron := newWithSeconds()
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
 	cron.AddFunc("0 0 0 1 1 ?", func() {})
 	cron.AddFunc("0 0 0 31 12 ?", func() {})
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 
 	cron.Start()
 	defer cron.Stop()
 
-	select {
-	case <-time.After(2 * OneSecond):
-		t.Error("expected job fires 2 times")
-	case <-wait(wg):
+	advanceFake(clk, time.Second, 2)
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("expected job fires 2 times, got %d", n)
 	}
 }
 
 func TestRunningMultipleSchedules(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-
-	cron := newWithSeconds()
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
 	cron.AddFunc("0 0 0 1 1 ?", func() {})
 	cron.AddFunc("0 0 0 31 12 ?", func() {})
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
+	cron.Schedule(Every(time.Minute), FuncJob(func() {}))
+	cron.Schedule(Every(time.Second), FuncJob(func() { atomic.AddInt64(&calls, 1) }))
+	cron.Schedule(Every(time.Hour), FuncJob(func() {}))
 
 	cron.Start()
 	defer cron.Stop()
 
-	select {
-	case <-time.After(2 * OneSecond):
-		t.Error("expected job fires 2 times")
-	case <-wait(wg):
+	advanceFake(clk, time.Second, 2)
+	if n := atomic.LoadInt64(&calls); n != 4 {
+		t.Errorf("expected each of the two jobs fires 2 times, got %d runs", n)
 	}
 }
 
 // Test that the cron is run in the local time zone (as opposed to UTC).
 func TestLocalTimezone(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
+	var runs []time.Time
+	start := time.Date(2020, 6, 1, 12, 30, 0, 0, time.Local)
+	spec := fmt.Sprintf("%d,%d %d %d %d %d ?",
+		start.Second()+1, start.Second()+2, start.Minute(), start.Hour(), start.Day(), start.Month())
+
+	cron, clk := newFakeCron(start)
+	cron.AddFunc(spec, func() { runs = append(runs, clk.Now()) })
+	cron.Start()
+	defer cron.Stop()
+
+	advanceFake(clk, time.Second, 2)
+	if len(runs) != 2 || !runs[0].Equal(start.Add(time.Second)) || !runs[1].Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected job fires 2 times, got %v", runs)
+	}
+}
 
-	now := time.Now()
-	// FIX: Issue #205
-	// This calculation doesn't work in seconds 58 or 59.
-	// Take the easy way out and sleep.
-	if now.Second() >= 58 {
-		time.Sleep(2 * time.Second)
-		now = time.Now()
+// Test that the cron is run in the given time zone (as opposed to local).
+func TestNonLocalTimezone(t *testing.T) {
+	var runs []time.Time
+	loc, err := time.LoadLocation("Atlantic/Cape_Verde")
+	if err != nil {
+		t.Fatalf("Failed to load time zone Atlantic/Cape_Verde: %+v", err)
 	}
+
+	start := time.Date(2020, 6, 1, 12, 30, 0, 0, loc)
 	spec := fmt.Sprintf("%d,%d %d %d %d %d ?",
-		now.Second()+1, now.Second()+2, now.Minute(), now.Hour(), now.Day(), now.Month())
+		start.Second()+1, start.Second()+2, start.Minute(), start.Hour(), start.Day(), start.Month())
+
+	// newFakeCron uses the location of the start time.
+	cron, clk := newFakeCron(start)
+	cron.AddFunc(spec, func() { runs = append(runs, clk.Now()) })
+	cron.Start()
+	defer cron.Stop()
+
+	advanceFake(clk, time.Second, 2)
+	if len(runs) != 2 || !runs[0].Equal(start.Add(time.Second)) || !runs[1].Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected job fires 2 times, got %v", runs)
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	tests := []struct {
+		spec string
+		loc  *time.Location
+		err  string
+	}{
+		{"0 0 9 * * *", time.Local, ""},
+		{"CRON_TZ=Asia/Shanghai 0 0 9 * * *", shanghai, ""},
+		{"TZ=Asia/Shanghai 0 0 9 * * *", shanghai, ""},
+		{"TZ=UTC  0 0 9 * * *", time.UTC, ""},
+		{"TZ=Asia/Nowhere 0 0 9 * * *", nil, "bad location"},
+		{"CRON_TZ=Asia/Shanghai", nil, "missing fields"},
+	}
+	for _, test := range tests {
+		sched, err := standardParser.Parse(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s => expected error containing %q, got %v", test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s => unexpected error %v", test.spec, err)
+			continue
+		}
+		if loc := sched.(*SpecSchedule).Location; loc.String() != test.loc.String() {
+			t.Errorf("%s => expected location %v, got %v", test.spec, test.loc, loc)
+		}
+	}
+}
+
+// 字段不足时报错，而不是只填充前面的字段
+func TestParseFieldCount(t *testing.T) {
+	for _, spec := range []string{"5", "0 0 * *", "0 0 0 * *", "TZ=UTC 0 0 * *"} {
+		if _, err := standardParser.Parse(spec); err == nil || !strings.Contains(err.Error(), "expected 6 to 6 fields") {
+			t.Errorf("%s => expected a field count error, got %v", spec, err)
+		}
+	}
+	if _, err := NewParser(Minute | Hour | Dom | Month | Dow).Parse("0 0 * *"); err == nil || !strings.Contains(err.Error(), "expected 5 to 5 fields, found 4") {
+		t.Errorf("expected a field count error for 4 of 5 fields, got %v", err)
+	}
+}
+
+func TestNextWithTz(t *testing.T) {
+	runs := []struct {
+		time, spec string
+		expected   string
+	}{
+		// Business hours in Shanghai computed from a UTC clock
+		{"2020-01-02T00:30:00Z", "TZ=Asia/Shanghai 0 0 9 * * *", "2020-01-02T01:00:00Z"},
+		{"2020-01-02T01:00:00Z", "TZ=Asia/Shanghai 0 0 9 * * *", "2020-01-03T01:00:00Z"},
+		{"2020-01-02T15:59:59Z", "CRON_TZ=Asia/Shanghai 0 0 0 * * *", "2020-01-02T16:00:00Z"},
+
+		// Spring forward: 02:30 does not exist on 2020-03-08 in New York
+		{"2020-03-08T01:59:59-05:00", "TZ=America/New_York 0 30 2 * * *", "2020-03-09T02:30:00-04:00"},
+		{"2020-03-08T01:59:59-05:00", "TZ=America/New_York 0 0 3 * * *", "2020-03-08T03:00:00-04:00"},
+		{"2020-03-07T12:00:00-05:00", "TZ=America/New_York 0 0 0 * * *", "2020-03-08T00:00:00-05:00"},
+		{"2020-03-08T00:00:00-05:00", "TZ=America/New_York 0 0 0 * * *", "2020-03-09T00:00:00-04:00"},
+
+		// Fall back: 01:30 happens twice on 2020-11-01 in New York
+		{"2020-11-01T00:59:59-04:00", "TZ=America/New_York 0 30 1 * * *", "2020-11-01T01:30:00-04:00"},
+		{"2020-10-31T12:00:00-04:00", "TZ=America/New_York 0 0 0 * * *", "2020-11-01T00:00:00-04:00"},
+		{"2020-11-01T00:00:00-04:00", "TZ=America/New_York 0 0 0 * * *", "2020-11-02T00:00:00-05:00"},
+	}
+
+	for _, c := range runs {
+		sched, err := standardParser.Parse(c.spec)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		now, _ := time.Parse(time.RFC3339, c.time)
+		expected, _ := time.Parse(time.RFC3339, c.expected)
+		actual := sched.Next(now)
+		if !actual.Equal(expected) {
+			t.Errorf("%s, \"%s\": (expected) %v != %v (actual)", c.time, c.spec, expected, actual)
+		}
+		if actual.Location() != now.Location() {
+			t.Errorf("%s, \"%s\": expected result in %v, got %v", c.time, c.spec, now.Location(), actual.Location())
+		}
+	}
+}
+
+func TestNextWithoutLocation(t *testing.T) {
+	// A literal SpecSchedule without Location behaves as if it were local.
+	sched := &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 9, Dom: all(dom), Month: all(months), Dow: all(dow)}
+	now := time.Date(2020, 1, 2, 8, 30, 0, 0, time.UTC)
+	expected := time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC)
+	if actual := sched.Next(now); !actual.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestEntryDelayUsesLocation(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	cron := New(WithLocation(loc))
+	if cron.Location() != loc {
+		t.Fatalf("expected location %v, got %v", loc, cron.Location())
+	}
+	id := cron.Schedule(&SpecSchedule{
+		Second: all(seconds), Minute: all(minutes), Hour: all(hours),
+		Dom: all(dom), Month: all(months), Dow: all(dow),
+		Location: time.Local,
+	}, FuncJob(func() {}))
+	if next := cron.Entry(id).Next; next.Location() != loc {
+		t.Errorf("expected next run computed in %v, got %v", loc, next.Location())
+	}
+}
+
+func TestParseDescriptors(t *testing.T) {
+	entries := []struct {
+		expr     string
+		expected Schedule
+	}{
+		{"@yearly", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: 1 << 1, Month: 1 << 1, Dow: all(dow), Location: time.Local}},
+		{"@annually", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: 1 << 1, Month: 1 << 1, Dow: all(dow), Location: time.Local}},
+		{"@monthly", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: 1 << 1, Month: all(months), Dow: all(dow), Location: time.Local}},
+		{"@weekly", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: all(dom), Month: all(months), Dow: 1 << 0, Location: time.Local}},
+		{"@daily", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: all(dom), Month: all(months), Dow: all(dow), Location: time.Local}},
+		{"@midnight", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: all(dom), Month: all(months), Dow: all(dow), Location: time.Local}},
+		{"@hourly", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: all(hours), Dom: all(dom), Month: all(months), Dow: all(dow), Location: time.Local}},
+		{"TZ=UTC @daily", &SpecSchedule{Second: 1 << 0, Minute: 1 << 0, Hour: 1 << 0, Dom: all(dom), Month: all(months), Dow: all(dow), Location: time.UTC}},
+		{"@every 5s", ConstantDelaySchedule{5 * time.Second}},
+		{"@every 1m30s", ConstantDelaySchedule{90 * time.Second}},
+		{"@every 5m", ConstantDelaySchedule{5 * time.Minute}},
+		{"@every 1.5s", ConstantDelaySchedule{1 * time.Second}},
+		{"@every 200ms", ConstantDelaySchedule{1 * time.Second}},
+	}
+	for _, c := range entries {
+		actual, err := standardParser.Parse(c.expr)
+		if err != nil {
+			t.Errorf("%s => unexpected error %v", c.expr, err)
+			continue
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(c.expected) {
+			t.Errorf("%s => expected %v, got %v", c.expr, c.expected, actual)
+		}
+	}
+
+	errors := []struct {
+		parser Parser
+		expr   string
+		err    string
+	}{
+		{standardParser, "@unknown", "unrecognized descriptor"},
+		{standardParser, "@every", "unrecognized descriptor"},
+		{standardParser, "@every 5", "failed to parse duration"},
+		{NewParser(Second | Minute | Hour | Dom | Month | Dow), "@daily", "does not accept descriptors"},
+	}
+	for _, c := range errors {
+		_, err := c.parser.Parse(c.expr)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s => expected error containing %q, got %v", c.expr, c.err, err)
+		}
+	}
+}
+
+func TestDescriptorNext(t *testing.T) {
+	runs := []struct {
+		time, spec string
+		expected   string
+	}{
+		{"Mon Jul 9 14:45:00 2012", "@yearly", "Tue Jan 1 00:00:00 2013"},
+		{"Mon Jul 9 14:45:00 2012", "@monthly", "Wed Aug 1 00:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "@weekly", "Sun Jul 15 00:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "@daily", "Tue Jul 10 00:00:00 2012"},
+		{"Mon Jul 9 23:59:59 2012", "@midnight", "Tue Jul 10 00:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "@hourly", "Mon Jul 9 15:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "@every 15m", "Mon Jul 9 15:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "@every 1m30s", "Mon Jul 9 14:46:30 2012"},
+		{"Mon Jul 9 14:45:00.005 2012", "@every 5s", "Mon Jul 9 14:45:05 2012"},
+		{"Mon Jul 9 14:45:00 2012", "@every 26h", "Tue Jul 10 16:45:00 2012"},
+	}
+	for _, c := range runs {
+		sched, err := standardParser.Parse(c.spec)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		actual := sched.Next(getTime(c.time))
+		expected := getTime(c.expected)
+		if !actual.Equal(expected) {
+			t.Errorf("%s, \"%s\": (expected) %v != %v (actual)", c.time, c.spec, expected, actual)
+		}
+	}
+}
+
+func TestExtendedDayNext(t *testing.T) {
+	runs := []struct {
+		time, spec string
+		expected   string
+	}{
+		// Last day of month, including leap years
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 L * ?", "Tue Jul 31 00:00:00 2012"},
+		{"Tue Jul 31 00:00:00 2012", "0 0 0 L * ?", "Fri Aug 31 00:00:00 2012"},
+		{"Wed Feb 1 00:00:00 2012", "0 0 0 L * ?", "Wed Feb 29 00:00:00 2012"},
+		{"Tue Feb 1 00:00:00 2011", "0 0 0 L * ?", "Mon Feb 28 00:00:00 2011"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1,L * ?", "Tue Jul 31 00:00:00 2012"},
+
+		// Last weekday of month
+		{"Mon Sep 10 00:00:00 2012", "0 0 0 LW * ?", "Fri Sep 28 00:00:00 2012"},
+		{"Sat Sep 29 00:00:00 2012", "0 0 0 LW * ?", "Wed Oct 31 00:00:00 2012"},
+
+		// Nearest weekday to the 15th, never crossing the month
+		{"Mon Jul 2 00:00:00 2012", "0 0 0 15W * ?", "Mon Jul 16 00:00:00 2012"},
+		{"Wed Aug 1 00:00:00 2012", "0 0 0 15W * ?", "Wed Aug 15 00:00:00 2012"},
+		{"Sat Sep 1 00:00:00 2012", "0 0 0 15W * ?", "Fri Sep 14 00:00:00 2012"},
+		{"Wed Aug 1 00:00:00 2012", "0 0 0 1W * ?", "Mon Sep 3 00:00:00 2012"},
+		{"Mon Jun 1 00:00:00 2015", "0 0 0 31W * ?", "Fri Jul 31 00:00:00 2015"},
+		{"Mon Mar 2 00:00:00 2015", "0 0 0 31W * ?", "Tue Mar 31 00:00:00 2015"},
+		{"Wed May 1 00:00:00 2013", "0 0 0 31W * ?", "Fri May 31 00:00:00 2013"},
+		{"Mon Aug 1 00:00:00 2016", "0 0 0 31W * ?", "Wed Aug 31 00:00:00 2016"},
+		{"Sat Dec 1 00:00:00 2018", "0 0 0 31W * ?", "Mon Dec 31 00:00:00 2018"},
+		{"Mon Feb 1 00:00:00 2016", "0 0 0 30W * ?", "Wed Mar 30 00:00:00 2016"},
+
+		// N-th weekday of month
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? * 5#2", "Fri Jul 13 00:00:00 2012"},
+		{"Fri Jul 13 00:00:00 2012", "0 0 0 ? * 5#2", "Fri Aug 10 00:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? * fri#1", "Fri Aug 3 00:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? * 1#5", "Mon Jul 30 00:00:00 2012"},
+		{"Tue Jul 31 00:00:00 2012", "0 0 0 ? * 1#5", "Mon Oct 29 00:00:00 2012"},
+
+		// Last weekday d of month
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? * 5L", "Fri Jul 27 00:00:00 2012"},
+		{"Fri Jul 27 00:00:00 2012", "0 0 0 ? * FRIL", "Fri Aug 31 00:00:00 2012"},
+		{"Wed Feb 1 00:00:00 2012", "0 0 0 ? * 3L", "Wed Feb 29 00:00:00 2012"},
+
+		// A bare L in the day-of-week field is Saturday, every week
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? * L", "Sat Jul 14 00:00:00 2012"},
+		{"Sat Jul 14 00:00:00 2012", "0 0 0 ? * l", "Sat Jul 21 00:00:00 2012"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? * 3,L", "Wed Jul 11 00:00:00 2012"},
+
+		// Extensions combine with the other fields
+		{"Mon Jul 9 14:45:00 2012", "0 30 9 L 2 ?", "Thu Feb 28 09:30:00 2013"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 ? 2 1#5", "Mon Feb 29 00:00:00 2016"},
+	}
+	for _, c := range runs {
+		sched, err := standardParser.Parse(c.spec)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		actual := sched.Next(getTime(c.time))
+		expected := getTime(c.expected)
+		if !actual.Equal(expected) {
+			t.Errorf("%s, \"%s\": (expected) %v != %v (actual)", c.time, c.spec, expected, actual)
+		}
+	}
+}
+
+func TestExtendedDayErrors(t *testing.T) {
+	errors := []struct {
+		expr, err string
+	}{
+		{"0 0 0 32W * ?", "out of range"},
+		{"0 0 0 0W * ?", "out of range"},
+		{"0 0 0 W * ?", "failed to parse int"},
+		{"0 0 0 ? * 5#0", "out of range"},
+		{"0 0 0 ? * 5#6", "out of range"},
+		{"0 0 0 ? * 7#1", "above maximum"},
+		{"0 0 0 ? * 8L", "above maximum"},
+		{"0 0 0 ? * xyz#1", "failed to parse int"},
+	}
+	for _, c := range errors {
+		_, err := standardParser.Parse(c.expr)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s => expected error containing %q, got %v", c.expr, c.err, err)
+		}
+	}
+}
+
+// yearParser accepts the optional year field on top of the standard fields.
+var yearParser = NewParser(Second | Minute | Hour | Dom | Month | Dow | Year | Descriptor)
+
+func TestYearNext(t *testing.T) {
+	runs := []struct {
+		time, spec string
+		expected   string
+	}{
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1 1 * *", "Tue Jan 1 00:00:00 2013"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1 1 * 2027-2030", "Fri Jan 1 00:00:00 2027"},
+		{"Fri Jan 1 00:00:00 2027", "0 0 0 1 1 * 2027-2030", "Sat Jan 1 00:00:00 2028"},
+		{"Tue Jan 1 00:00:00 2030", "0 0 0 1 1 * 2027-2030", ""},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1 1 * 2012", ""},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 * * * 2012", "Tue Jul 10 00:00:00 2012"},
+		{"Mon Dec 31 00:00:00 2012", "0 0 0 * * * 2012,2014", "Wed Jan 1 00:00:00 2014"},
+		{"Mon Jul 9 14:45:00 2012", "0 30 9 29 2 ? 2013-2099", "Mon Feb 29 09:30:00 2016"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1 1 * 2020/10", "Wed Jan 1 00:00:00 2020"},
+		{"Wed Jan 1 00:00:00 2020", "0 0 0 1 1 * 2020/10", "Fri Jan 1 00:00:00 2030"},
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1 1 * */50", "Thu Jan 1 00:00:00 2020"},
+
+		// Beyond the default five year search window
+		{"Mon Jul 9 14:45:00 2012", "0 0 0 1 1 * 2050", "Sat Jan 1 00:00:00 2050"},
+	}
+	for _, c := range runs {
+		sched, err := yearParser.Parse(c.spec)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		actual := sched.Next(getTime(c.time))
+		expected := getTime(c.expected)
+		if !actual.Equal(expected) {
+			t.Errorf("%s, \"%s\": (expected) %v != %v (actual)", c.time, c.spec, expected, actual)
+		}
+	}
+}
+
+func TestYearParse(t *testing.T) {
+	entries := []struct {
+		parser   Parser
+		expr     string
+		expected []int
+		err      string
+	}{
+		{yearParser, "0 0 0 1 1 *", nil, ""},
+		{yearParser, "0 0 0 1 1 * ?", nil, ""},
+		{yearParser, "0 0 0 1 1 * 2027-2030", []int{2027, 2028, 2029, 2030}, ""},
+		{yearParser, "0 0 0 1 1 * 2030,2027", []int{2027, 2030}, ""},
+		{NewParser(Minute | Hour | Dom | Month | Dow | Year), "0 0 1 1 * 2027", []int{2027}, ""},
+		{yearParser, "0 0 0 1 1 * 1969", nil, "below minimum"},
+		{yearParser, "0 0 0 1 1 * 2100", nil, "above maximum"},
+		{yearParser, "0 0 0 1 1 * 2030-2027", nil, "beyond end of range"},
+		{yearParser, "0 0 0 1 1 * 2027/0", nil, "positive number"},
+		{standardParser, "0 0 0 1 1 * 2027", nil, "expected 6 to 6 fields"},
+		{yearParser, "0 0 0 1 1", nil, "expected 6 to 7 fields, found 5"},
+	}
+	for _, c := range entries {
+		sched, err := c.parser.Parse(c.expr)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s => expected error containing %q, got %v", c.expr, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s => unexpected error %v", c.expr, err)
+			continue
+		}
+		if actual := sched.(*SpecSchedule).Year; fmt.Sprint(actual) != fmt.Sprint(c.expected) || (actual == nil) != (c.expected == nil) {
+			t.Errorf("%s => expected years %v, got %v", c.expr, c.expected, actual)
+		}
+	}
+}
+
+// Add an @every job, start cron, expect it runs at the given delay.
+func TestEveryDescriptor(t *testing.T) {
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	if _, err := cron.AddFunc("@every 1s", func() { atomic.AddInt64(&calls, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	cron.Start()
+	defer cron.Stop()
+
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("expected @every job runs once, got %d", n)
+	}
+}
 
+func getTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	layouts := []string{
+		"Mon Jan 2 15:04:05 2006",
+		"Mon Jan 2 15:04:05.000 2006",
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t
+		}
+	}
+	panic("could not parse time value " + value)
+}
+
+// Test that Entries returns snapshots sorted by their next activation.
+func TestEntries(t *testing.T) {
 	cron := newWithSeconds()
-	cron.AddFunc(spec, func() { wg.Done() })
+	yearly, _ := cron.AddFunc("@yearly", func() {})
+	every, _ := cron.AddFunc("* * * * * ?", func() {})
+	never := cron.Schedule(new(ZeroSchedule), FuncJob(func() {}))
+	daily, _ := cron.AddFunc("@daily", func() {})
+
+	entries := cron.Entries()
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	expected := []EntryID{every, daily, yearly, never}
+	for i, e := range entries {
+		if e.ID != expected[i] {
+			t.Errorf("entry %d: expected id %d, got %d", i, expected[i], e.ID)
+		}
+	}
+	if !entries[3].Next.IsZero() {
+		t.Errorf("expected unsatisfiable schedule to have zero Next, got %v", entries[3].Next)
+	}
+
+	// Modifying the snapshot does not affect the scheduled entry.
+	entries[0].Next = time.Time{}
+	if cron.Entry(every).Next.IsZero() {
+		t.Error("expected snapshot to be a copy")
+	}
+}
+
+// Test that Entry returns the zero entry for unknown or removed ids.
+func TestEntryLookup(t *testing.T) {
+	cron := newWithSeconds()
+	id, _ := cron.AddFunc("@hourly", func() {})
+	if e := cron.Entry(id); !e.Valid() || e.ID != id || e.Next.IsZero() {
+		t.Errorf("expected a valid entry with id %d, got %+v", id, e)
+	}
+	if e := cron.Entry(id + 1); e.Valid() {
+		t.Errorf("expected zero entry for unknown id, got %+v", e)
+	}
+	cron.Remove(id)
+	if e := cron.Entry(id); e.Valid() {
+		t.Errorf("expected zero entry for removed id, got %+v", e)
+	}
+	if len(cron.Entries()) != 0 {
+		t.Errorf("expected no entries after remove, got %v", cron.Entries())
+	}
+}
+
+// Test that Prev and Next are maintained as the job runs.
+func TestEntryPrevNext(t *testing.T) {
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	id, _ := cron.AddFunc("* * * * * ?", func() {})
+	first := cron.Entry(id).Next
+	if !cron.Entry(id).Prev.IsZero() {
+		t.Error("expected zero Prev before the first run")
+	}
 	cron.Start()
 	defer cron.Stop()
 
+	advanceFake(clk, time.Second, 1)
+	e := cron.Entry(id)
+	if !e.Prev.Equal(first) {
+		t.Errorf("expected Prev %v, got %v", first, e.Prev)
+	}
+	if !e.Next.Equal(e.Prev.Add(time.Second)) {
+		t.Errorf("expected Next one second after %v, got %v", e.Prev, e.Next)
+	}
+}
+
+// Test that entries can be listed while jobs are added, removed and run.
+func TestEntriesConcurrent(t *testing.T) {
+	cron := newWithSeconds()
+	cron.Start()
+	defer cron.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id, _ := cron.AddFunc("* * * * * ?", func() {})
+				cron.Entry(id)
+				cron.Remove(id)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, e := range cron.Entries() {
+					_ = e.Next
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStopAndWait(t *testing.T) {
+	// 假时钟不再推进，没有任务会开始；Stop返回的ctx只要没有在等待任务就会完成
+	t.Run("nothing running, returns immediately", func(t *testing.T) {
+		cron, _ := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cron.AddFunc("* * * * * *", func() {})
+		cron.Start()
+		<-cron.Stop().Done()
+	})
+
+	t.Run("repeated calls to Stop", func(t *testing.T) {
+		cron, _ := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cron.Start()
+		<-cron.Stop().Done()
+		<-cron.Stop().Done()
+	})
+
+	t.Run("a couple fast jobs added, still returns immediately", func(t *testing.T) {
+		cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cron.AddFunc("* * * * * *", func() {})
+		cron.Start()
+		cron.AddFunc("* * * * * *", func() {})
+		cron.AddFunc("* * * * * *", func() {})
+		cron.AddFunc("* * * * * *", func() {})
+		advanceFake(clk, time.Second, 1)
+		<-cron.Stop().Done()
+	})
+
+	t.Run("a couple fast jobs and a slow job added, waits for slow job", func(t *testing.T) {
+		// Jobs run on their own goroutines, the slow one must not hold the reaper.
+		clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cron := New(WithClock(clk))
+		started, finish := make(chan struct{}), make(chan struct{})
+		cron.AddFunc("* * * * * *", func() {})
+		cron.Start()
+		cron.AddFunc("* * * * * *", func() {
+			started <- struct{}{}
+			<-finish
+		})
+		cron.AddFunc("* * * * * *", func() {})
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+		<-started
+
+		ctx := cron.Stop()
+
+		// Verify that it is not done while the slow job is still running
+		if ctx.Err() != nil {
+			t.Error("context was done while the slow job was running")
+		}
+
+		// Verify that it IS done once the slow job returns
+		close(finish)
+		<-ctx.Done()
+	})
+
+	t.Run("stopped cron does not start new jobs", func(t *testing.T) {
+		var calls int64
+		cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cron.AddFunc("* * * * * *", func() { atomic.AddInt64(&calls, 1) })
+		cron.Start()
+		advanceFake(clk, time.Second, 1)
+		<-cron.Stop().Done()
+		before := atomic.LoadInt64(&calls)
+		clk.Advance(time.Second)
+		if after := atomic.LoadInt64(&calls); after != before {
+			t.Errorf("expected no runs after Stop, got %d", after-before)
+		}
+	})
+}
+
+// Test that jobs are run by the configured executor.
+func TestWithExecutor(t *testing.T) {
+	executor, err := timer.NewPoolExecutor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer executor.Release()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cron := New(WithExecutor(executor), WithClock(clk))
+	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	cron.Start()
+	defer cron.Stop()
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
 	select {
-	case <-time.After(OneSecond * 2):
-		t.Error("expected job fires 2 times")
+	case <-time.After(OneSecond):
+		t.Error("expected jobs run on the pool")
 	case <-wait(wg):
 	}
 }
 
+// every100ms is a sub-second schedule.
+type every100ms struct{}
+
+func (every100ms) Next(t time.Time) time.Time {
+	return t.Truncate(100 * time.Millisecond).Add(100 * time.Millisecond)
+}
+
+// Test that a timer with a fine tick runs sub-second schedules.
+func TestWithTimerSubSecond(t *testing.T) {
+	var calls int64
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	tm := timer.NewSystemTimer(timer.WithTickMs(10), timer.WithWheelSize(100), timer.WithClock(clk), timer.WithExecutor(timer.SyncExecutor{}))
+	cron := New(WithTimer(tm), WithClock(clk))
+	cron.Schedule(every100ms{}, FuncJob(func() { atomic.AddInt64(&calls, 1) }))
+	cron.Start()
+	defer cron.Stop()
+
+	advanceFake(clk, 10*time.Millisecond, 100)
+	if n := atomic.LoadInt64(&calls); n != 10 {
+		t.Errorf("expected 10 calls in a second, got %d", n)
+	}
+}
+
+// Test that several crons can share one timing wheel.
+func TestWithTimerShared(t *testing.T) {
+	var calls [2]int64
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	shared := timer.NewSystemTimer(timer.WithTickMs(10), timer.WithWheelSize(100), timer.WithClock(clk), timer.WithExecutor(timer.SyncExecutor{}))
+	cron1 := New(WithTimer(shared), WithClock(clk))
+	cron2 := New(WithTimer(shared), WithClock(clk))
+	cron1.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls[0], 1) })
+	cron2.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls[1], 1) })
+	cron1.Start()
+	defer cron1.Stop()
+	cron2.Start()
+	defer cron2.Stop()
+
+	advanceFake(clk, time.Second, 1)
+	if atomic.LoadInt64(&calls[0]) != 1 || atomic.LoadInt64(&calls[1]) != 1 {
+		t.Errorf("expected jobs of both crons run once, got %v", calls)
+	}
+}
+
+// Test that adding an entry due within the first tick does not deadlock when
+// the timer runs it synchronously inside Add.
+func TestWithTimerSyncExecutorDueEntry(t *testing.T) {
+	// With a tick of 2s, the entry due at 00:00:01 is already expired when
+	// it is added at 00:00:00.5.
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, int(500*time.Millisecond), time.UTC))
+	tm := timer.NewSystemTimer(timer.WithTickMs(2000), timer.WithClock(clk), timer.WithExecutor(timer.SyncExecutor{}))
+	cron := New(WithTimer(tm), WithClock(clk), WithLocation(time.UTC))
+	cron.Start()
+	defer cron.Stop()
+
+	var calls int64
+	added := make(chan struct{})
+	go func() {
+		cron.AddFunc("* * * * * *", func() { atomic.AddInt64(&calls, 1) })
+		close(added)
+	}()
+	select {
+	case <-time.After(OneSecond):
+		t.Fatal("expected AddFunc to return")
+	case <-added:
+	}
+	if atomic.LoadInt64(&calls) != 1 {
+		t.Errorf("called %d times, expected 1", calls)
+	}
+}
+
 // Test that calling stop before start silently returns without
 // blocking the stop channel.
 func TestStopWithoutStart(t *testing.T) {
@@ -323,11 +955,9 @@ func TestInvalidJobSpec(t *testing.T) {
 
 // Test blocking run method behaves as Start()
 func TestBlockingRun(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	cron := newWithSeconds()
-	cron.AddFunc("* * * * * ?", func() { wg.Done() })
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 
 	var unblockChan = make(chan struct{})
 
@@ -337,39 +967,35 @@ func TestBlockingRun(t *testing.T) {
 	}()
 	defer cron.Stop()
 
+	advanceFake(clk, time.Second, 1)
 	select {
-	case <-time.After(OneSecond):
-		t.Error("expected job fires")
 	case <-unblockChan:
 		t.Error("expected that Run() blocks")
-	case <-wait(wg):
+	default:
+	}
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("expected job fires once, got %d", n)
 	}
 }
 
 // Test that double-running is a no-op
 func TestStartNoop(t *testing.T) {
-	var tickChan = make(chan struct{}, 2)
-
-	cron := newWithSeconds()
-	cron.AddFunc("* * * * * ?", func() {
-		tickChan <- struct{}{}
-	})
+	var calls int64
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
 
 	cron.Start()
 	defer cron.Stop()
 
 	// Wait for the first firing to ensure the runner is going
-	<-tickChan
+	advanceFake(clk, time.Second, 1)
 
 	cron.Start()
 
-	<-tickChan
-
-	// Fail if this job fires again in a short period, indicating a double-run
-	select {
-	case <-time.After(time.Millisecond):
-	case <-tickChan:
-		t.Error("expected job fires exactly twice")
+	// Fail if the job fires more than once a second, indicating a double-run
+	advanceFake(clk, time.Second, 1)
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("expected job fires exactly twice, got %d", n)
 	}
 }
 
@@ -381,13 +1007,13 @@ func (*ZeroSchedule) Next(time.Time) time.Time {
 
 // Tests that job without time does not run
 func TestJobWithZeroTimeDoesNotRun(t *testing.T) {
-	cron := newWithSeconds()
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
 	var calls int64
 	cron.AddFunc("* * * * * *", func() { atomic.AddInt64(&calls, 1) })
 	cron.Schedule(new(ZeroSchedule), FuncJob(func() { t.Error("expected zero task will not run") }))
 	cron.Start()
 	defer cron.Stop()
-	<-time.After(OneSecond)
+	advanceFake(clk, time.Second, 1)
 	if atomic.LoadInt64(&calls) != 1 {
 		t.Errorf("called %d times, expected 1\n", calls)
 	}
@@ -423,37 +1049,120 @@ func newWithSeconds() *Cron {
 	return New(WithChain())
 }
 
+// newFakeCron returns a cron driven by a fake clock, running jobs on the
+// reaper goroutine so that the clock only moves once they are done.
+func newFakeCron(start time.Time, opts ...Option) (*Cron, *clock.FakeClock) {
+	clk := clock.NewFake(start)
+	opts = append([]Option{WithClock(clk), WithLocation(start.Location()), WithExecutor(timer.SyncExecutor{})}, opts...)
+	return New(opts...), clk
+}
+
+// advanceFake moves the fake clock forward in steps, waiting after each one
+// for the reaper to run the jobs that came due and wait on the clock again.
+func advanceFake(clk *clock.FakeClock, step time.Duration, n int) {
+	for i := 0; i < n; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(step)
+	}
+	clk.BlockUntil(1)
+}
+
 func TestCron(t *testing.T) {
-	go func() {
-		ip := "0.0.0.0:6060"
-		fmt.Printf("start pprof success on %s\n", ip)
-		if err := http.ListenAndServe(ip, nil); err != nil {
-			fmt.Printf("start pprof failed on %s\n", ip)
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var counts [3]int
+	for i, spec := range []string{"0/1 * * * * *", "0/2 * * * * *", "0/3 * * * * *"} {
+		i := i
+		cron.AddFunc(spec, func() { counts[i]++ })
+	}
+	cron.Start()
+	defer cron.Stop()
+
+	advanceFake(clk, time.Second, 60)
+	if counts != [3]int{60, 30, 20} {
+		t.Errorf("expected 60, 30 and 20 runs in a minute, got %v", counts)
+	}
+}
+
+func TestCronSimulatedWeek(t *testing.T) {
+	// 2020-01-01 is a Wednesday.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cron, clk := newFakeCron(start)
+	var hourly, weekdays []time.Time
+	cron.AddFunc("@hourly", func() { hourly = append(hourly, clk.Now()) })
+	cron.AddFunc("0 30 9 * * MON-FRI", func() { weekdays = append(weekdays, clk.Now()) })
+	cron.Start()
+	defer cron.Stop()
+
+	advanceFake(clk, time.Hour, 7*24)
+	if len(hourly) != 7*24 {
+		t.Fatalf("expected %d hourly runs, got %d", 7*24, len(hourly))
+	}
+	for i, ran := range hourly {
+		if expected := start.Add(time.Duration(i+1) * time.Hour); !ran.Equal(expected) {
+			t.Fatalf("expected hourly run %d at %v, got %v", i, expected, ran)
 		}
-	}()
-	cron := New()
-	/*cron.AddFunc("3 * * * * *", func() {
-		//log.Println("3-time")
-	})
-	cron.AddFunc("30 * * * * *", func() {
-		//log.Println("30-time")
-	})
-	cron.AddFunc("0/5 * * * * *", func() {
-		//log.Println("0/5-time")
-	})
+	}
+	if len(weekdays) != 5 {
+		t.Fatalf("expected 5 weekday runs, got %v", weekdays)
+	}
+	for _, ran := range weekdays {
+		if ran.Weekday() == time.Saturday || ran.Weekday() == time.Sunday {
+			t.Errorf("expected no run on the weekend, got %v", ran)
+		}
+	}
+	if last := cron.Entries()[0].Prev; !last.Equal(start.Add(7 * 24 * time.Hour)) {
+		t.Errorf("expected the last hourly run at %v, got %v", start.Add(7*24*time.Hour), last)
+	}
+}
 
-	cron.AddFunc("1/10 * * * * *", func() {
-		//log.Println("1/10-time")
-	})*/
-	cron.AddFunc("0/1 * * * * *", func() {
-		log.Println("0/1-time")
-	})
-	cron.AddFunc("0/2 * * * * *", func() {
-		log.Println("0/2-time")
-	})
-	cron.AddFunc("0/3 * * * * *", func() {
-		log.Println("0/3-time")
-	})
-	fmt.Printf("开始时间：%v \n", time.Now())
-	cron.Run()
+func TestContextJob(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	cron := New(WithClock(clk), WithLocation(time.UTC))
+	started := make(chan JobInfo)
+	cancelled := make(chan EntryID)
+	run := func(ctx context.Context) {
+		info, _ := JobInfoFrom(ctx)
+		started <- info
+		<-ctx.Done()
+		cancelled <- info.ID
+	}
+	removed, _ := cron.AddContextFunc("@every 2s", run)
+	stopped, _ := cron.AddContextJob("@every 3s", ContextFuncJob(run))
+	cron.Start()
+
+	// 2s时第一个任务开始执行，移除后上下文被取消
+	advanceFake(clk, time.Second, 2)
+	info := <-started
+	if info.ID != removed || !info.Scheduled.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("unexpected job info %+v", info)
+	}
+	cron.Remove(removed)
+	if id := <-cancelled; id != removed {
+		t.Fatalf("expected the removed job to be cancelled, got entry %d", id)
+	}
+
+	// 3s时第二个任务开始执行，Stop取消其上下文；执行期间没有其他任务，不能等待收割器
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	if info := <-started; info.ID != stopped {
+		t.Fatalf("expected entry %d to run, got %+v", stopped, info)
+	}
+	ctx := cron.Stop()
+	if id := <-cancelled; id != stopped {
+		t.Fatalf("expected the running job to be cancelled by Stop, got entry %d", id)
+	}
+	<-ctx.Done()
+}
+
+func TestWithoutContext(t *testing.T) {
+	cron, clk := newFakeCron(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	runs := 0
+	cron.ScheduleContext(Every(time.Second), WithoutContext(FuncJob(func() { runs++ })))
+	cron.Start()
+	defer cron.Stop()
+	advanceFake(clk, time.Second, 3)
+	if runs != 3 {
+		t.Errorf("expected 3 runs of the adapted job, got %d", runs)
+	}
 }
@@ -1,10 +1,24 @@
 package cron
 
+import (
+	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+	"github.com/GuoCeng/time-wheel/timer"
+)
+
 type Option func(*Cron)
 
+// WithLocation overrides the timezone of the cron instance.
+func WithLocation(loc *time.Location) Option {
+	return func(c *Cron) {
+		c.location = loc
+	}
+}
+
 func WithMinutes() Option {
 	return WithParser(NewParser(
-		Minute | Hour | Dom | Month | Dow,
+		Minute | Hour | Dom | Month | Dow | Descriptor,
 	))
 }
 
@@ -21,3 +35,29 @@ func WithChain(wrappers ...JobWrapper) Option {
 		c.chain = NewChain(wrappers...)
 	}
 }
+
+// WithTimer specifies the timer that schedules the jobs of this cron, e.g. a
+// timer.SystemTimer with a finer tick, or one shared by several Cron
+// instances. The executor configured with WithExecutor is not used then.
+func WithTimer(t timer.Timer) Option {
+	return func(c *Cron) {
+		c.timer = t
+	}
+}
+
+// WithExecutor specifies the timer.Executor that runs the jobs of this cron,
+// e.g. a timer.PoolExecutor to bound the number of jobs running at once.
+func WithExecutor(e timer.Executor) Option {
+	return func(c *Cron) {
+		c.executor = e
+	}
+}
+
+// WithClock specifies the clock schedules are evaluated against, e.g. a
+// clock.FakeClock in tests. A timer given with WithTimer should use the same
+// clock.
+func WithClock(clk clock.Clock) Option {
+	return func(c *Cron) {
+		c.clock = clk
+	}
+}
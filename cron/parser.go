@@ -5,6 +5,7 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ParseOption int
@@ -16,6 +17,8 @@ const (
 	Dom
 	Month
 	Dow
+	Descriptor // Allow descriptors such as @monthly, @weekly, etc.
+	Year       // Optional seventh field restricting the years, e.g. 2027-2030; opt in with NewParser
 )
 
 var places = []ParseOption{
@@ -25,6 +28,7 @@ var places = []ParseOption{
 	Dom,
 	Month,
 	Dow,
+	Year,
 }
 
 var defaults = []string{
@@ -34,10 +38,11 @@ var defaults = []string{
 	"*",
 	"*",
 	"*",
+	"*",
 }
 
 var standardParser = NewParser(
-	Second | Minute | Hour | Dom | Month | Dow,
+	Second | Minute | Hour | Dom | Month | Dow | Descriptor,
 )
 
 type Parser struct {
@@ -48,11 +53,46 @@ func NewParser(options ParseOption) Parser {
 	return Parser{options}
 }
 
+// Parse returns a new crontab schedule representing the given spec.
+// It returns a descriptive error if the spec is not valid.
+//
+// The spec may be prefixed with a time zone in the form "CRON_TZ=Area/City"
+// or "TZ=Area/City"; the schedule is then computed in that location. Without
+// a prefix the schedule runs in the location of the time passed to Next,
+// which for a Cron is the location configured with WithLocation.
+//
+// Besides ranges, steps and lists, the day-of-month field accepts "L" (last
+// day), "LW" (last weekday) and "15W" (weekday nearest the 15th), and the
+// day-of-week field accepts "5L" (last Friday), "5#2" (second Friday) and,
+// as in Quartz, a bare "L" for the last day of the week, Saturday.
 func (p Parser) Parse(spec string) (Schedule, error) {
 	if len(spec) == 0 {
 		return nil, fmt.Errorf("empty spec string")
 	}
 
+	// Extract timezone if present
+	var loc = time.Local
+	if strings.HasPrefix(spec, "TZ=") || strings.HasPrefix(spec, "CRON_TZ=") {
+		var err error
+		i := strings.Index(spec, " ")
+		if i < 0 {
+			return nil, fmt.Errorf("missing fields after location: %s", spec)
+		}
+		eq := strings.Index(spec, "=")
+		if loc, err = time.LoadLocation(spec[eq+1 : i]); err != nil {
+			return nil, fmt.Errorf("provided bad location %s: %v", spec[eq+1:i], err)
+		}
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	// Handle named schedules (descriptors), if configured
+	if strings.HasPrefix(spec, "@") {
+		if p.options&Descriptor == 0 {
+			return nil, fmt.Errorf("parser does not accept descriptors: %v", spec)
+		}
+		return parseDescriptor(spec, loc)
+	}
+
 	// Split on whitespace.
 	fields := strings.Fields(spec)
 
@@ -72,25 +112,42 @@ func (p Parser) Parse(spec string) (Schedule, error) {
 		return bits
 	}
 
+	dayField := func(field string, r bounds, ext func(string) (uint64, bool, error)) (uint64, uint64) {
+		if err != nil {
+			return 0, 0
+		}
+		var bits, extBits uint64
+		bits, extBits, err = getDayField(field, r, ext)
+		return bits, extBits
+	}
+
 	var (
-		second     = field(fields[0], seconds)
-		minute     = field(fields[1], minutes)
-		hour       = field(fields[2], hours)
-		dayofmonth = field(fields[3], dom)
-		month      = field(fields[4], months)
-		dayofweek  = field(fields[5], dow)
+		second                    = field(fields[0], seconds)
+		minute                    = field(fields[1], minutes)
+		hour                      = field(fields[2], hours)
+		dayofmonth, dayofmonthExt = dayField(fields[3], dom, getDomExt)
+		month                     = field(fields[4], months)
+		dayofweek, dayofweekExt   = dayField(lastDayOfWeek(fields[5]), dow, getDowExt)
 	)
+	var year []int
+	if err == nil {
+		year, err = getYears(fields[6])
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &SpecSchedule{
-		Second: second,
-		Minute: minute,
-		Hour:   hour,
-		Dom:    dayofmonth,
-		Month:  month,
-		Dow:    dayofweek,
+		Second:   second,
+		Minute:   minute,
+		Hour:     hour,
+		Dom:      dayofmonth,
+		Month:    month,
+		Dow:      dayofweek,
+		DomExt:   dayofmonthExt,
+		DowExt:   dayofweekExt,
+		Year:     year,
+		Location: loc,
 	}, nil
 }
 
@@ -103,9 +160,13 @@ func normalizeFields(fields []string, options ParseOption) ([]string, error) {
 		}
 	}
 
-	// Validate number of fields
-	if count := len(fields); count < 1 || count > max {
-		return nil, fmt.Errorf("expected %d to %d fields, found %d: %s", 1, max, count, fields)
+	// Validate number of fields; only the trailing year may be omitted
+	min := max
+	if options&Year > 0 {
+		min--
+	}
+	if count := len(fields); count < min || count > max {
+		return nil, fmt.Errorf("expected %d to %d fields, found %d: %s", min, max, count, fields)
 	}
 
 	// Populate all fields not part of options with their defaults
@@ -114,6 +175,9 @@ func normalizeFields(fields []string, options ParseOption) ([]string, error) {
 	copy(expandedFields, defaults)
 	for i, place := range places {
 		if options&place > 0 {
+			if place == Year && n == len(fields) {
+				break
+			}
 			expandedFields[i] = fields[n]
 			n++
 		}
@@ -134,6 +198,104 @@ func getField(field string, r bounds) (uint64, error) {
 	return bits, nil
 }
 
+// getDayField is like getField for the day-of-month and day-of-week fields,
+// but first offers every expression to ext so the Quartz-style extensions
+// (L, W, #) can be collected separately from the plain bit set.
+func getDayField(field string, r bounds, ext func(string) (uint64, bool, error)) (uint64, uint64, error) {
+	var bits, extBits uint64
+	ranges := strings.FieldsFunc(field, func(r rune) bool { return r == ',' })
+	for _, expr := range ranges {
+		bit, ok, err := ext(expr)
+		if err != nil {
+			return bits, extBits, err
+		}
+		if ok {
+			extBits |= bit
+			continue
+		}
+		bit, err = getRange(expr, r)
+		if err != nil {
+			return bits, extBits, err
+		}
+		bits |= bit
+	}
+	return bits, extBits, nil
+}
+
+// getDomExt parses the day-of-month extensions "L", "LW" and "nW".
+// It returns false if expr is a regular range expression.
+func getDomExt(expr string) (uint64, bool, error) {
+	upper := strings.ToUpper(expr)
+	switch {
+	case upper == "L":
+		return lastDomBit, true, nil
+	case upper == "LW":
+		return lastWeekdayBit, true, nil
+	case strings.HasSuffix(upper, "W"):
+		day, err := mustParseInt(expr[:len(expr)-1])
+		if err != nil {
+			return 0, false, err
+		}
+		if day < dom.min || day > dom.max {
+			return 0, false, fmt.Errorf("day of month (%d) out of range [%d, %d]: %s", day, dom.min, dom.max, expr)
+		}
+		return 1 << day, true, nil
+	}
+	return 0, false, nil
+}
+
+// getDowExt parses the day-of-week extensions "dL" (last d of the month) and
+// "d#n" (n-th d of the month). It returns false if expr is a regular range
+// expression.
+func getDowExt(expr string) (uint64, bool, error) {
+	if i := strings.Index(expr, "#"); i >= 0 {
+		day, err := getDow(expr[:i], expr)
+		if err != nil {
+			return 0, false, err
+		}
+		n, err := mustParseInt(expr[i+1:])
+		if err != nil {
+			return 0, false, err
+		}
+		if n < 1 || n > 5 {
+			return 0, false, fmt.Errorf("occurrence (%d) out of range [1, 5]: %s", n, expr)
+		}
+		return nthDowBit(day, n), true, nil
+	}
+	if len(expr) > 1 && strings.HasSuffix(strings.ToUpper(expr), "L") {
+		day, err := getDow(expr[:len(expr)-1], expr)
+		if err != nil {
+			return 0, false, err
+		}
+		return 1 << day, true, nil
+	}
+	return 0, false, nil
+}
+
+// lastDayOfWeek replaces a bare "L" in the day-of-week field with Saturday,
+// the last day of the week.
+func lastDayOfWeek(field string) string {
+	exprs := strings.Split(field, ",")
+	for i, expr := range exprs {
+		if strings.EqualFold(expr, "L") {
+			exprs[i] = "6"
+		}
+	}
+	return strings.Join(exprs, ",")
+}
+
+// getDow parses a single day of week, by number or by name.
+func getDow(s, expr string) (uint, error) {
+	day, err := parseIntOrName(s, dow.names)
+	if err != nil {
+		return 0, err
+	}
+	if day > dow.max {
+		return 0, fmt.Errorf("day of week (%d) above maximum (%d): %s", day, dow.max, expr)
+	}
+	return day, nil
+}
+
 func getRange(expr string, r bounds) (uint64, error) {
 	var (
 		start, end, step uint
@@ -201,6 +363,80 @@ func getRange(expr string, r bounds) (uint64, error) {
 	return getBits(start, end, step) | extra, nil
 }
 
+// getYears returns the sorted set of years selected by the year field, or nil
+// if every year is allowed. It accepts the same lists, ranges and steps as
+// the other fields, within the years bounds.
+func getYears(field string) ([]int, error) {
+	selected := make([]bool, years.max-years.min+1)
+	ranges := strings.FieldsFunc(field, func(r rune) bool { return r == ',' })
+	for _, expr := range ranges {
+		var (
+			start, end, step uint
+			rangeAndStep     = strings.Split(expr, "/")
+			lowAndHigh       = strings.Split(rangeAndStep[0], "-")
+			err              error
+		)
+		if lowAndHigh[0] == "*" || lowAndHigh[0] == "?" {
+			if len(rangeAndStep) == 1 {
+				return nil, nil
+			}
+			start, end = years.min, years.max
+		} else {
+			if start, err = mustParseInt(lowAndHigh[0]); err != nil {
+				return nil, err
+			}
+			switch len(lowAndHigh) {
+			case 1:
+				end = start
+			case 2:
+				if end, err = mustParseInt(lowAndHigh[1]); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("too many hyphens: %s", expr)
+			}
+		}
+
+		switch len(rangeAndStep) {
+		case 1:
+			step = 1
+		case 2:
+			if step, err = mustParseInt(rangeAndStep[1]); err != nil {
+				return nil, err
+			}
+			if len(lowAndHigh) == 1 {
+				end = years.max
+			}
+		default:
+			return nil, fmt.Errorf("too many slashes: %s", expr)
+		}
+
+		if start < years.min {
+			return nil, fmt.Errorf("beginning of range (%d) below minimum (%d): %s", start, years.min, expr)
+		}
+		if end > years.max {
+			return nil, fmt.Errorf("end of range (%d) above maximum (%d): %s", end, years.max, expr)
+		}
+		if start > end {
+			return nil, fmt.Errorf("beginning of range (%d) beyond end of range (%d): %s", start, end, expr)
+		}
+		if step == 0 {
+			return nil, fmt.Errorf("step of range should be a positive number: %s", expr)
+		}
+		for y := start; y <= end; y += step {
+			selected[y-years.min] = true
+		}
+	}
+
+	var set []int
+	for i, ok := range selected {
+		if ok {
+			set = append(set, int(years.min)+i)
+		}
+	}
+	return set, nil
+}
+
 func parseIntOrName(expr string, names map[string]uint) (uint, error) {
 	if names != nil {
 		if namedInt, ok := names[strings.ToLower(expr)]; ok {
@@ -238,3 +474,75 @@ func getBits(min, max, step uint) uint64 {
 func all(r bounds) uint64 {
 	return getBits(r.min, r.max, 1) | starBit
 }
+
+// parseDescriptor returns a predefined schedule for the expression, or error if none matches.
+func parseDescriptor(descriptor string, loc *time.Location) (Schedule, error) {
+	switch descriptor {
+	case "@yearly", "@annually":
+		return &SpecSchedule{
+			Second:   1 << seconds.min,
+			Minute:   1 << minutes.min,
+			Hour:     1 << hours.min,
+			Dom:      1 << dom.min,
+			Month:    1 << months.min,
+			Dow:      all(dow),
+			Location: loc,
+		}, nil
+
+	case "@monthly":
+		return &SpecSchedule{
+			Second:   1 << seconds.min,
+			Minute:   1 << minutes.min,
+			Hour:     1 << hours.min,
+			Dom:      1 << dom.min,
+			Month:    all(months),
+			Dow:      all(dow),
+			Location: loc,
+		}, nil
+
+	case "@weekly":
+		return &SpecSchedule{
+			Second:   1 << seconds.min,
+			Minute:   1 << minutes.min,
+			Hour:     1 << hours.min,
+			Dom:      all(dom),
+			Month:    all(months),
+			Dow:      1 << dow.min,
+			Location: loc,
+		}, nil
+
+	case "@daily", "@midnight":
+		return &SpecSchedule{
+			Second:   1 << seconds.min,
+			Minute:   1 << minutes.min,
+			Hour:     1 << hours.min,
+			Dom:      all(dom),
+			Month:    all(months),
+			Dow:      all(dow),
+			Location: loc,
+		}, nil
+
+	case "@hourly":
+		return &SpecSchedule{
+			Second:   1 << seconds.min,
+			Minute:   1 << minutes.min,
+			Hour:     all(hours),
+			Dom:      all(dom),
+			Month:    all(months),
+			Dow:      all(dow),
+			Location: loc,
+		}, nil
+
+	}
+
+	const every = "@every "
+	if strings.HasPrefix(descriptor, every) {
+		duration, err := time.ParseDuration(descriptor[len(every):])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration %s: %s", descriptor, err)
+		}
+		return Every(duration), nil
+	}
+
+	return nil, fmt.Errorf("unrecognized descriptor: %s", descriptor)
+}
@@ -1,9 +1,26 @@
 package cron
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
+// SpecSchedule specifies a duty cycle (to the second granularity), based on a
+// traditional crontab specification. It is computed initially and stored as bit sets.
 type SpecSchedule struct {
 	Second, Minute, Hour, Dom, Month, Dow uint64
+
+	// Quartz-style day extensions that can only be resolved against a concrete
+	// month. DomExt holds "L" (lastDomBit), "LW" (lastWeekdayBit) and "nW"
+	// (bit n); DowExt holds "dL" (bit d) and "d#n" (bit nthDowBit(d, n)).
+	DomExt, DowExt uint64
+
+	// Year is the sorted set of years the schedule may fire in; nil means
+	// every year.
+	Year []int
+
+	// Override location for this schedule. Nil is treated as time.Local.
+	Location *time.Location
 }
 
 type bounds struct {
@@ -16,6 +33,7 @@ var (
 	minutes = bounds{0, 59, nil}
 	hours   = bounds{0, 23, nil}
 	dom     = bounds{1, 31, nil}
+	years   = bounds{1970, 2099, nil}
 	months  = bounds{1, 12, map[string]uint{
 		"jan": 1,
 		"feb": 2,
@@ -43,25 +61,63 @@ var (
 
 const (
 	starBit = 1 << 63
+
+	// lastDomBit marks "L" in DomExt; day 0 never appears in a month.
+	lastDomBit = 1 << 0
+	// lastWeekdayBit marks "LW" in DomExt, above the 31 "nW" bits.
+	lastWeekdayBit = 1 << 32
 )
 
+// nthDowBit returns the DowExt bit for "d#n", the n-th (1-5) weekday d of
+// the month. The low 7 bits are reserved for "dL".
+func nthDowBit(d, n uint) uint64 {
+	return 1 << (7 + d*5 + n - 1)
+}
+
+// Next returns the next time this schedule is activated, greater than the given
+// time.  If no time can be found to satisfy the schedule, return the zero time.
 func (s *SpecSchedule) Next(t time.Time) time.Time {
+	// Convert the given time into the schedule's timezone, if one is specified.
+	// Save the original timezone so we can convert back after we find a time.
+	// Note that schedules without a time zone specified (time.Local) are treated
+	// as local to the time provided.
+	origLocation := t.Location()
+	loc := s.Location
+	if loc == nil || loc == time.Local {
+		loc = t.Location()
+	} else {
+		t = t.In(loc)
+	}
 
 	t = t.Add(1*time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
 
 	added := false
 
+	// If no time is found within five years (or after the last year of the
+	// year set), return zero.
 	yearLimit := t.Year() + 5
+	if len(s.Year) > 0 {
+		yearLimit = s.Year[len(s.Year)-1]
+	}
 
 WRAP:
 	if t.Year() > yearLimit {
 		return time.Time{}
 	}
 
+	if !s.yearMatches(t.Year()) {
+		year, ok := s.nextYear(t.Year())
+		if !ok {
+			return time.Time{}
+		}
+		added = true
+		t = time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	}
+
 	for 1<<uint(t.Month())&s.Month == 0 {
 		if !added {
 			added = true
-			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
 		}
 		t = t.AddDate(0, 1, 0)
 
@@ -73,9 +129,18 @@ WRAP:
 	for !dayMatches(s, t) {
 		if !added {
 			added = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
 		}
 		t = t.AddDate(0, 0, 1)
+		// Notice if the hour is no longer midnight due to DST.
+		// Add an hour if it's 23, subtract an hour if it's 1.
+		if t.Hour() != 0 {
+			if t.Hour() > 12 {
+				t = t.Add(time.Duration(24-t.Hour()) * time.Hour)
+			} else {
+				t = t.Add(time.Duration(-t.Hour()) * time.Hour)
+			}
+		}
 		if t.Day() == 1 {
 			goto WRAP
 		}
@@ -84,7 +149,7 @@ WRAP:
 	for 1<<uint(t.Hour())&s.Hour == 0 {
 		if !added {
 			added = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
 		}
 		t = t.Add(1 * time.Hour)
 
@@ -117,16 +182,93 @@ WRAP:
 		}
 	}
 
-	return t
+	return t.In(origLocation)
+}
+
+// yearMatches returns true if the year is part of the schedule's year set.
+func (s *SpecSchedule) yearMatches(year int) bool {
+	if s.Year == nil {
+		return true
+	}
+	i := sort.SearchInts(s.Year, year)
+	return i < len(s.Year) && s.Year[i] == year
+}
+
+// nextYear returns the first year of the year set after the given one.
+func (s *SpecSchedule) nextYear(year int) (int, bool) {
+	i := sort.SearchInts(s.Year, year+1)
+	if i == len(s.Year) {
+		return 0, false
+	}
+	return s.Year[i], true
 }
 
+// dayMatches returns true if the schedule's day-of-week and day-of-month
+// restrictions are satisfied by the given time.
 func dayMatches(s *SpecSchedule, t time.Time) bool {
 	var (
-		domMatch bool = 1<<uint(t.Day())&s.Dom > 0
-		dowMatch bool = 1<<uint(t.Weekday())&s.Dow > 0
+		domMatch bool = 1<<uint(t.Day())&s.Dom > 0 || domExtMatches(s.DomExt, t)
+		dowMatch bool = 1<<uint(t.Weekday())&s.Dow > 0 || dowExtMatches(s.DowExt, t)
 	)
 	if s.Dom&starBit > 0 || s.Dow&starBit > 0 {
 		return domMatch && dowMatch
 	}
 	return domMatch || dowMatch
 }
+
+// domExtMatches reports whether t satisfies one of the "L", "LW" or "nW"
+// day-of-month expressions in ext.
+func domExtMatches(ext uint64, t time.Time) bool {
+	if ext == 0 {
+		return false
+	}
+	day, last := t.Day(), daysIn(t)
+	if ext&lastDomBit > 0 && day == last {
+		return true
+	}
+	if ext&lastWeekdayBit > 0 && day == nearestWeekday(t, last) {
+		return true
+	}
+	for n := 1; n <= last; n++ {
+		if ext&(1<<uint(n)) > 0 && day == nearestWeekday(t, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// dowExtMatches reports whether t satisfies one of the "dL" or "d#n"
+// day-of-week expressions in ext.
+func dowExtMatches(ext uint64, t time.Time) bool {
+	if ext == 0 {
+		return false
+	}
+	d, day := uint(t.Weekday()), t.Day()
+	if ext&(1<<d) > 0 && day+7 > daysIn(t) {
+		return true
+	}
+	return ext&nthDowBit(d, uint(day-1)/7+1) > 0
+}
+
+// daysIn returns the number of days in the month of t.
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// nearestWeekday returns the weekday (Monday to Friday) closest to the given
+// day of t's month, without crossing into the previous or next month.
+func nearestWeekday(t time.Time, day int) int {
+	switch time.Date(t.Year(), t.Month(), day, 0, 0, 0, 0, time.UTC).Weekday() {
+	case time.Saturday:
+		if day == 1 {
+			return day + 2
+		}
+		return day - 1
+	case time.Sunday:
+		if day == daysIn(t) {
+			return day - 2
+		}
+		return day + 1
+	}
+	return day
+}
@@ -1,5 +1,5 @@
 module github.com/GuoCeng/time-wheel
 
-go 1.13
+go 1.18
 
 require github.com/panjf2000/ants/v2 v2.2.2
@@ -1,106 +1,597 @@
 package queue
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
 )
 
+// ErrQueueClosed is returned by Offer once the queue has been released.
+var ErrQueueClosed = errors.New("queue: delay queue released")
+
+// ErrQueueFull is returned by TryOffer, and by Offer once its context is
+// done, when a queue created with WithCapacity has no room left.
+var ErrQueueFull = errors.New("queue: delay queue full")
+
 type Delayed interface {
 	GetDelay() time.Duration
 }
 
-func NewDelay() *DelayQueue {
+// Metrics receives the offer events of a DelayQueue, e.g. to export them as
+// counters. Its methods are called outside of the queue's lock and must be
+// safe for concurrent use.
+type Metrics interface {
+	// OfferAccepted is called for every element added to the queue.
+	OfferAccepted()
 
-	return &DelayQueue{
-		available: make(chan struct{}, 1),
-		count:     new(int64),
-		q:         NewPriority(),
+	// OfferBlocked is called when Offer has to wait for room in a full queue.
+	OfferBlocked()
+
+	// OfferRejected is called when Offer or TryOffer fails, with
+	// ErrQueueFull or ErrQueueClosed.
+	OfferRejected(err error)
+}
+
+// delayConfig holds the settings given to NewDelay or NewDelayOf.
+type delayConfig struct {
+	clock    clock.Clock
+	capacity int
+	metrics  Metrics
+}
+
+// Option configures a DelayQueue.
+type Option func(*delayConfig)
+
+// WithClock sets the clock Pop waits on, clock.System by default. Elements
+// compute their own delays, so they should use the same clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *delayConfig) {
+		cfg.clock = c
 	}
 }
 
-type DelayQueue struct {
+// WithCapacity bounds the number of elements in the queue. Offer blocks and
+// TryOffer fails while the queue is full. Queues are unbounded by default.
+func WithCapacity(n int) Option {
+	if n <= 0 {
+		panic("queue: capacity must be positive")
+	}
+	return func(cfg *delayConfig) {
+		cfg.capacity = n
+	}
+}
+
+// WithMetrics sets the Metrics notified of offers.
+func WithMetrics(m Metrics) Option {
+	return func(cfg *delayConfig) {
+		cfg.metrics = m
+	}
+}
+
+// DelayQueueOf is a queue of Delayed values of type T, from which a value can
+// only be taken once its delay has expired. It is unbounded unless created
+// with WithCapacity. GetDelay is called
+// once when a value is offered and the resulting expiration is kept as its
+// priority; call Update if the delay of a queued value changes.
+type DelayQueueOf[T Delayed] struct {
 	mu        sync.Mutex
+	clock     clock.Clock
+	epoch     time.Time
 	count     *int64
-	available chan struct{}
-	q         *PriorityQueue
+	available chan struct{} // 唤醒一个等待的调用方
+	closed    chan struct{}
+	released  bool
+	leader    bool        // 是否有调用方正在按堆顶的到期时间等待
+	timer     clock.Timer // leader等待的定时器，堆顶变化时重新设置
+	capacity  int
+	notFull   chan struct{} // 有元素被取出时关闭并替换，唤醒所有等待空间的Offer
+	metrics   Metrics
+	q         *PriorityQueueOf[*delayItem[T]]
 }
 
-func (dq *DelayQueue) Offer(e Delayed) {
-	dq.mu.Lock()
-	defer dq.mu.Unlock()
-	i := &Item{
-		Value:    e,
-		Priority: func() int64 { return int64(e.GetDelay()) },
+// delayItem 队列中的元素及其到期时间
+type delayItem[T Delayed] struct {
+	value T
+	exp   time.Duration // 到期时间，相对于队列的epoch
+}
+
+// 到期时间早的元素排在前面
+func delayLess[T Delayed](a, b *delayItem[T]) bool {
+	return a.exp < b.exp
+}
+
+func NewDelayOf[T Delayed](opts ...Option) *DelayQueueOf[T] {
+	cfg := delayConfig{clock: clock.System}
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	dq.q.Push(i)
-	count := atomic.AddInt64(dq.count, 1)
-	if dq.q.Len() == 1 && count == 1 {
-		go func() {
-			dq.available <- struct{}{}
-		}()
+	q := NewPriorityOf(delayLess[T])
+	//元素实现了Indexed时，告知其在堆中的位置
+	q.h.setIndex = func(item *delayItem[T], i int) { setIndexOf(item.value, i) }
+	return &DelayQueueOf[T]{
+		available: make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		count:     new(int64),
+		q:         q,
+		clock:     cfg.clock,
+		epoch:     cfg.clock.Now(),
+		capacity:  cfg.capacity,
+		notFull:   make(chan struct{}),
+		metrics:   cfg.metrics,
 	}
 }
 
-func (dq *DelayQueue) Pop(ctx context.Context) interface{} {
-	var delayTime time.Duration
-Start:
-	dq.mu.Lock()
-	first, ok := dq.q.Peek().(*Item)
-	if !ok {
+// elapsed returns the time since the queue was created, the origin of the
+// expirations of its elements.
+func (dq *DelayQueueOf[T]) elapsed() time.Duration {
+	return dq.clock.Now().Sub(dq.epoch)
+}
+
+// signal wakes up a goroutine waiting in Pop, if any.
+func (dq *DelayQueueOf[T]) signal() {
+	select {
+	case dq.available <- struct{}{}:
+	default:
+	}
+}
+
+// Offer adds e to the queue. If the queue is full, it waits for room until
+// ctx is done and then fails with ErrQueueFull. It fails with ErrQueueClosed
+// once the queue has been released.
+func (dq *DelayQueueOf[T]) Offer(ctx context.Context, e T) error {
+	blocked := false
+	for {
+		dq.mu.Lock()
+		err := dq.offer(e)
+		notFull := dq.notFull
 		dq.mu.Unlock()
-		goto Wait
+		if err != ErrQueueFull {
+			dq.report(err)
+			return err
+		}
+		if !blocked && dq.metrics != nil {
+			dq.metrics.OfferBlocked()
+		}
+		blocked = true
+		select {
+		case <-notFull:
+		case <-dq.closed:
+		case <-ctx.Done():
+			dq.report(ErrQueueFull)
+			return ErrQueueFull
+		}
+	}
+}
+
+// TryOffer adds e to the queue without waiting, or fails with ErrQueueFull
+// if the queue is full.
+func (dq *DelayQueueOf[T]) TryOffer(e T) error {
+	dq.mu.Lock()
+	err := dq.offer(e)
+	dq.mu.Unlock()
+	dq.report(err)
+	return err
+}
+
+// offer adds e unless the queue is released or full. It must be called with
+// mu held.
+func (dq *DelayQueueOf[T]) offer(e T) error {
+	if dq.released {
+		return ErrQueueClosed
+	}
+	if dq.capacity > 0 && dq.q.Len() >= dq.capacity {
+		return ErrQueueFull
+	}
+	dq.push(e)
+	return nil
+}
+
+// push adds e regardless of the capacity. It must be called with mu held.
+func (dq *DelayQueueOf[T]) push(e T) {
+	item := &delayItem[T]{value: e, exp: dq.elapsed() + e.GetDelay()}
+	dq.q.Push(item)
+	atomic.AddInt64(dq.count, 1)
+	if first, _ := dq.q.Peek(); first == item {
+		dq.headChanged()
+	}
+}
+
+// report notifies the metrics of the outcome of an offer.
+func (dq *DelayQueueOf[T]) report(err error) {
+	if dq.metrics == nil {
+		return
+	}
+	if err != nil {
+		dq.metrics.OfferRejected(err)
 	} else {
-		if delayed, ok := first.Value.(Delayed); ok {
-			delay := delayed.GetDelay()
-			delayTime = delay
-			//精度设置为毫秒，与时间轮的精度毫秒匹配，不然容易出现延时任务执行时间出现偏差
-			if delay < 1*time.Millisecond {
-				defer dq.mu.Unlock()
-				item := dq.q.Pop().(*Item)
-				atomic.AddInt64(dq.count, -1)
-				return item.Value
-			} else {
+		dq.metrics.OfferAccepted()
+	}
+}
+
+// taken records that n elements left the queue and wakes up the offers
+// waiting for room. It must be called with mu held.
+func (dq *DelayQueueOf[T]) taken(n int) {
+	atomic.AddInt64(dq.count, -int64(n))
+	if dq.capacity > 0 && n > 0 && dq.q.Len()+n >= dq.capacity {
+		close(dq.notFull)
+		dq.notFull = make(chan struct{})
+	}
+}
+
+// Pop waits for the head of the queue to expire and removes it. It returns
+// false if ctx is done or the queue is released first.
+func (dq *DelayQueueOf[T]) Pop(ctx context.Context) (T, bool) {
+	return dq.take(ctx.Done(), nil)
+}
+
+// PollTimeout waits up to d, measured by the queue's clock, for the head of
+// the queue to expire and removes it. It returns false if nothing expired in
+// time or the queue is released.
+func (dq *DelayQueueOf[T]) PollTimeout(d time.Duration) (T, bool) {
+	if d <= 0 {
+		return dq.Poll()
+	}
+	timer := dq.clock.NewTimer(d)
+	defer timer.Stop()
+	return dq.take(nil, timer.C())
+}
+
+// take waits for the head of the queue to expire and removes it, giving up
+// when done is closed or deadline fires.
+//
+// 采用leader/follower模式：同一时刻只有一个调用方（leader）按堆顶的到期时间
+// 在队列的定时器上等待，其余调用方等待available通知。堆顶变化时重新设置定时器，
+// leader离开时唤醒一个等待者接替。
+func (dq *DelayQueueOf[T]) take(done <-chan struct{}, deadline <-chan time.Time) (T, bool) {
+	var zero T
+	for {
+		dq.mu.Lock()
+		if dq.released {
+			dq.mu.Unlock()
+			return zero, false
+		}
+		first, ok := dq.q.Peek()
+		if ok {
+			delay := first.exp - dq.elapsed()
+			if delay <= 0 {
+				dq.q.Pop()
+				dq.taken(1)
+				if !dq.leader && dq.q.Len() > 0 {
+					dq.signal()
+				}
+				dq.mu.Unlock()
+				return first.value, true
+			}
+			if !dq.leader {
+				dq.leader = true
+				dq.arm(delay)
+				timeout := dq.timer.C()
+				dq.mu.Unlock()
+				var quit bool
+				select {
+				case <-timeout:
+				case <-done:
+					quit = true
+				case <-deadline:
+					quit = true
+				case <-dq.closed:
+					quit = true
+				}
+				dq.mu.Lock()
+				dq.leader = false
+				//停止定时器，避免假时钟上残留等待者
+				dq.timer.Stop()
+				if quit && dq.q.Len() > 0 {
+					dq.signal()
+				}
 				dq.mu.Unlock()
-				goto Wait
+				if quit {
+					//取消或超时后不再取出元素，即使堆顶同时到期
+					return zero, false
+				}
+				continue
 			}
 		}
+		dq.mu.Unlock()
+		//队列为空或已有leader在等待堆顶到期
+		select {
+		case <-dq.available:
+		case <-done:
+			return zero, false
+		case <-deadline:
+			return zero, false
+		case <-dq.closed:
+			return zero, false
+		}
+	}
+}
+
+// arm sets the leader's timer to fire after d. A value left in the channel
+// by an earlier expiration only causes a spurious wakeup, as the leader
+// checks the head again. It must be called with mu held.
+func (dq *DelayQueueOf[T]) arm(d time.Duration) {
+	if dq.timer == nil {
+		dq.timer = dq.clock.NewTimer(d)
+		return
 	}
+	dq.timer.Stop()
+	dq.timer.Reset(d)
+}
 
-Wait:
-	select {
-	case <-ctx.Done():
-		return nil
-	case <-dq.available:
-		goto Start
-	case <-time.After(delayTime):
-		goto Start
+// headChanged re-arms the leader's timer for the new head of the queue, or
+// wakes up a waiting caller to become the leader if there is none. It must
+// be called with mu held.
+func (dq *DelayQueueOf[T]) headChanged() {
+	if !dq.leader {
+		dq.signal()
+		return
 	}
+	var delay time.Duration
+	if first, ok := dq.q.Peek(); ok {
+		delay = first.exp - dq.elapsed()
+	}
+	dq.arm(delay)
 }
 
-func (dq *DelayQueue) Poll() interface{} {
+// Poll removes and returns the head of the queue if it has expired, without
+// waiting.
+func (dq *DelayQueueOf[T]) Poll() (T, bool) {
+	var zero T
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if dq.released {
+		return zero, false
+	}
+	first, ok := dq.q.Peek()
+	if !ok || first.exp > dq.elapsed() {
+		return zero, false
+	}
+	dq.q.Pop()
+	dq.taken(1)
+	return first.value, true
+}
+
+// Peek returns the head of the queue without removing it, whether or not it
+// has expired. It returns false if the queue is empty.
+func (dq *DelayQueueOf[T]) Peek() (T, bool) {
 	dq.mu.Lock()
 	defer dq.mu.Unlock()
-	first, ok := dq.q.Peek().(*Item)
-	if !ok {
+	if first, ok := dq.q.Peek(); ok {
+		return first.value, true
+	}
+	var zero T
+	return zero, false
+}
+
+// DrainTo removes every expired element, at most max of them if max is
+// positive, in one locked pass and appends them to dst in order of
+// expiration.
+func (dq *DelayQueueOf[T]) DrainTo(dst []T, max int) []T {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if dq.released {
+		return dst
+	}
+	now := dq.elapsed()
+	drained := 0
+	for max <= 0 || drained < max {
+		first, ok := dq.q.Peek()
+		if !ok || first.exp > now {
+			break
+		}
+		dq.q.Pop()
+		dst = append(dst, first.value)
+		drained++
+	}
+	dq.taken(drained)
+	return dst
+}
+
+// Len returns the number of elements in the queue, expired or not.
+func (dq *DelayQueueOf[T]) Len() int {
+	return int(atomic.LoadInt64(dq.count))
+}
+
+// indexOf returns the index of e in the heap h, or -1. e must implement
+// Indexed.
+func indexOf[T Delayed](h *heapOf[*delayItem[T]], e T) int {
+	i := indexed(e).Index()
+	if i >= 0 && i < len(h.items) && sameValue(h.items[i].value, e) {
+		return i
+	}
+	return -1
+}
+
+// Update recomputes the expiration of a queued element from its GetDelay, in
+// O(log n), and reports whether it was found. e must implement Indexed.
+func (dq *DelayQueueOf[T]) Update(e T) bool {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	found := false
+	dq.q.locked(func(h *heapOf[*delayItem[T]]) {
+		if i := indexOf(h, e); i >= 0 {
+			h.items[i].exp = dq.elapsed() + e.GetDelay()
+			heap.Fix(h, i)
+			found = true
+		}
+	})
+	if found {
+		//到期时间可能提前，重新计算等待时间
+		dq.headChanged()
+	}
+	return found
+}
+
+// Contains reports whether e is in the queue, in O(1). e must implement
+// Indexed.
+func (dq *DelayQueueOf[T]) Contains(e T) bool {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	found := false
+	dq.q.locked(func(h *heapOf[*delayItem[T]]) {
+		found = indexOf(h, e) >= 0
+	})
+	return found
+}
+
+// Remove removes e from the queue in O(log n) and reports whether it was
+// found. e must implement Indexed. Goroutines waiting in Pop are woken up if
+// e was the head of the queue.
+func (dq *DelayQueueOf[T]) Remove(e T) bool {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	i := -1
+	dq.q.locked(func(h *heapOf[*delayItem[T]]) {
+		if i = indexOf(h, e); i >= 0 {
+			heap.Remove(h, i)
+		}
+	})
+	if i < 0 {
+		return false
+	}
+	dq.taken(1)
+	if i == 0 {
+		dq.headChanged()
+	}
+	return true
+}
+
+// RemoveIf removes every element for which f returns true and returns the
+// number of elements removed. Goroutines waiting in Pop are woken up if the
+// head of the queue changed.
+func (dq *DelayQueueOf[T]) RemoveIf(f func(T) bool) int {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	head, _ := dq.q.Peek()
+	removed := dq.q.RemoveIf(func(item *delayItem[T]) bool { return f(item.value) })
+	if removed == 0 {
+		return 0
+	}
+	dq.taken(removed)
+	if newHead, _ := dq.q.Peek(); newHead != head {
+		dq.headChanged()
+	}
+	return removed
+}
+
+// Release closes the queue and returns the elements it still held, in no
+// particular order. Goroutines blocked in Pop are woken up and, like every
+// later Pop or Poll, get nothing; later Offer calls fail with ErrQueueClosed.
+// Calling Release more than once is safe, later calls return nil.
+func (dq *DelayQueueOf[T]) Release() []T {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if dq.released {
 		return nil
-	} else {
-		if delayed, ok := first.Value.(Delayed); ok {
-			delay := delayed.GetDelay()
-			if delay <= 0 {
-				item := dq.q.Pop().(*Item)
-				atomic.AddInt64(dq.count, -1)
-				return item.Value
-			} else {
-				return nil
-			}
-		} else {
-			return nil
+	}
+	dq.released = true
+	close(dq.closed)
+	var pending []T
+	for {
+		item, ok := dq.q.Pop()
+		if !ok {
+			break
 		}
+		pending = append(pending, item.value)
+	}
+	atomic.StoreInt64(dq.count, 0)
+	return pending
+}
+
+func NewDelay(opts ...Option) *DelayQueue {
+	return &DelayQueue{q: NewDelayOf[Delayed](opts...)}
+}
+
+// DelayQueue is a DelayQueueOf[Delayed] with the untyped API: Pop and Poll
+// return nil rather than false.
+type DelayQueue struct {
+	q *DelayQueueOf[Delayed]
+}
+
+// Offer adds e to the queue, waiting for room until ctx is done, see
+// DelayQueueOf.Offer.
+func (dq *DelayQueue) Offer(ctx context.Context, e Delayed) error {
+	return dq.q.Offer(ctx, e)
+}
+
+// TryOffer adds e to the queue without waiting, see DelayQueueOf.TryOffer.
+func (dq *DelayQueue) TryOffer(e Delayed) error {
+	return dq.q.TryOffer(e)
+}
+
+func (dq *DelayQueue) Pop(ctx context.Context) interface{} {
+	if e, ok := dq.q.Pop(ctx); ok {
+		return e
+	}
+	return nil
+}
+
+func (dq *DelayQueue) Poll() interface{} {
+	if e, ok := dq.q.Poll(); ok {
+		return e
+	}
+	return nil
+}
+
+// PollTimeout waits up to d for an element to expire, see
+// DelayQueueOf.PollTimeout. It returns nil if none did.
+func (dq *DelayQueue) PollTimeout(d time.Duration) interface{} {
+	if e, ok := dq.q.PollTimeout(d); ok {
+		return e
 	}
+	return nil
+}
+
+// Peek returns the head of the queue without removing it, or nil if the
+// queue is empty.
+func (dq *DelayQueue) Peek() interface{} {
+	if e, ok := dq.q.Peek(); ok {
+		return e
+	}
+	return nil
+}
+
+// DrainTo appends the expired elements to dst, see DelayQueueOf.DrainTo.
+func (dq *DelayQueue) DrainTo(dst []Delayed, max int) []Delayed {
+	return dq.q.DrainTo(dst, max)
+}
+
+// Len returns the number of elements in the queue.
+func (dq *DelayQueue) Len() int {
+	return dq.q.Len()
+}
+
+// Contains reports whether e is in the queue, see DelayQueueOf.Contains. e
+// must implement Indexed.
+func (dq *DelayQueue) Contains(e Delayed) bool {
+	return dq.q.Contains(e)
 }
 
-func (dq *DelayQueue) Release() {
+// Remove removes e from the queue, see DelayQueueOf.Remove. e must implement
+// Indexed.
+func (dq *DelayQueue) Remove(e Delayed) bool {
+	return dq.q.Remove(e)
+}
+
+// RemoveIf removes every element for which f returns true and returns the
+// number of elements removed, see DelayQueueOf.RemoveIf.
+func (dq *DelayQueue) RemoveIf(f func(interface{}) bool) int {
+	return dq.q.RemoveIf(func(e Delayed) bool { return f(e) })
+}
+
+// Update recomputes the expiration of a queued element, see
+// DelayQueueOf.Update. e must implement Indexed.
+func (dq *DelayQueue) Update(e Delayed) bool {
+	return dq.q.Update(e)
+}
 
+// Release closes the queue and returns the elements it still held, see
+// DelayQueueOf.Release.
+func (dq *DelayQueue) Release() []Delayed {
+	return dq.q.Release()
 }
@@ -2,8 +2,12 @@ package queue
 
 import (
 	"context"
+	"math/rand"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
 )
 
 type Demo struct {
@@ -35,13 +39,14 @@ func TestDelayQueue_Pop(t *testing.T) {
 	}
 
 	dq := NewDelay()
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 	go func() {
 		g := dq.Pop(ctx).(*Demo)
 		t.Logf("=============time:%v;g.msg:%v;g.time:%v", time.Now().Second(), g.Msg, g.Time)
 	}()
-	dq.Offer(d1)
-	dq.Offer(d2)
+	dq.TryOffer(d1)
+	dq.TryOffer(d2)
 	g2 := dq.Pop(ctx).(*Demo)
 	t.Logf("time:%v;g.msg:%v;g.time:%v", time.Now().Second(), g2.Msg, g2.Time)
 
@@ -57,3 +62,445 @@ func TestSelect(t *testing.T) {
 		t.Logf("default")
 	}
 }
+
+func TestDelayQueue_Release(t *testing.T) {
+	dq := NewDelay()
+	now := time.Now()
+	dq.TryOffer(&Demo{Msg: "demo1", Exp: now.Add(time.Hour)})
+	dq.TryOffer(&Demo{Msg: "demo2", Exp: now.Add(2 * time.Hour)})
+
+	const waiters = 3
+	done := make(chan interface{}, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			done <- dq.Pop(context.Background())
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	pending := dq.Release()
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending elements, got %d", len(pending))
+	}
+	for i := 0; i < waiters; i++ {
+		select {
+		case v := <-done:
+			if v != nil {
+				t.Errorf("expected nil from Pop after Release, got %v", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected blocked Pop to return after Release")
+		}
+	}
+
+	if err := dq.TryOffer(&Demo{Msg: "demo3", Exp: now}); err != ErrQueueClosed {
+		t.Errorf("expected ErrQueueClosed, got %v", err)
+	}
+	if v := dq.Pop(context.Background()); v != nil {
+		t.Errorf("expected nil from Pop after Release, got %v", v)
+	}
+	if v := dq.Poll(); v != nil {
+		t.Errorf("expected nil from Poll after Release, got %v", v)
+	}
+	if pending := dq.Release(); pending != nil {
+		t.Errorf("expected second Release to return nil, got %v", pending)
+	}
+}
+
+// fakeDelayed 按假时钟计算延时
+type fakeDelayed struct {
+	name  string
+	exp   time.Time
+	clock *clock.FakeClock
+	index int
+}
+
+func (d *fakeDelayed) GetDelay() time.Duration {
+	return d.exp.Sub(d.clock.Now())
+}
+
+func (d *fakeDelayed) Index() int     { return d.index }
+func (d *fakeDelayed) SetIndex(i int) { d.index = i }
+
+func TestDelayQueueOf(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	for _, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		dq.TryOffer(&fakeDelayed{name: d.String(), exp: clk.Now().Add(d), clock: clk})
+	}
+	if _, ok := dq.Poll(); ok {
+		t.Fatal("expected no element to be due yet")
+	}
+
+	popped := make(chan *fakeDelayed)
+	go func() {
+		for {
+			d, ok := dq.Pop(context.Background())
+			if !ok {
+				close(popped)
+				return
+			}
+			popped <- d
+		}
+	}()
+	for _, expected := range []string{"1s", "2s", "3s"} {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+		if d := <-popped; d.name != expected {
+			t.Fatalf("expected %s to be popped, got %s", expected, d.name)
+		}
+	}
+	dq.Release()
+	if _, ok := <-popped; ok {
+		t.Error("expected Pop to return false after Release")
+	}
+}
+
+func TestDelayQueueOf_Update(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	late := &fakeDelayed{name: "late", exp: clk.Now().Add(time.Hour), clock: clk}
+	dq.TryOffer(late)
+	dq.TryOffer(&fakeDelayed{name: "soon", exp: clk.Now().Add(time.Minute), clock: clk})
+
+	// 延时在入队时计算一次，修改后需要调用Update
+	late.exp = clk.Now().Add(time.Second)
+	clk.Advance(time.Second)
+	if _, ok := dq.Poll(); ok {
+		t.Fatal("expected the stale expiration to be kept until Update")
+	}
+	if !dq.Update(late) {
+		t.Fatal("expected Update to find the element")
+	}
+	if d, ok := dq.Poll(); !ok || d != late {
+		t.Fatalf("expected the updated element to be due, got %v", d)
+	}
+	if dq.Update(late) {
+		t.Error("expected Update not to find a removed element")
+	}
+}
+
+// benchDelayed 已经到期的元素，GetDelay每次都读取时钟
+type benchDelayed struct {
+	exp time.Time
+}
+
+func (d *benchDelayed) GetDelay() time.Duration {
+	return time.Until(d.exp)
+}
+
+func benchElements(n int) []*benchDelayed {
+	r := rand.New(rand.NewSource(1))
+	now := time.Now()
+	elements := make([]*benchDelayed, n)
+	for i := range elements {
+		elements[i] = &benchDelayed{exp: now.Add(-time.Duration(r.Int63n(int64(time.Hour))))}
+	}
+	return elements
+}
+
+// BenchmarkDelayQueueOf_1M 入队并取出一百万个元素，到期时间在入队时缓存
+func BenchmarkDelayQueueOf_1M(b *testing.B) {
+	elements := benchElements(1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dq := NewDelayOf[*benchDelayed]()
+		for _, e := range elements {
+			dq.TryOffer(e)
+		}
+		for {
+			if _, ok := dq.Poll(); !ok {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkGetDelayPerComparison_1M 对照组：每次比较都调用GetDelay，即缓存之前的做法
+func BenchmarkGetDelayPerComparison_1M(b *testing.B) {
+	elements := benchElements(1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pq := NewPriorityOf(func(a, b *benchDelayed) bool { return a.GetDelay() < b.GetDelay() })
+		for _, e := range elements {
+			pq.Push(e)
+		}
+		for {
+			if _, ok := pq.Pop(); !ok {
+				break
+			}
+		}
+	}
+}
+
+func TestDelayQueueOf_Remove(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	first := &fakeDelayed{name: "first", exp: clk.Now().Add(time.Second), clock: clk}
+	second := &fakeDelayed{name: "second", exp: clk.Now().Add(time.Minute), clock: clk}
+	third := &fakeDelayed{name: "third", exp: clk.Now().Add(time.Hour), clock: clk}
+	dq.TryOffer(first)
+	dq.TryOffer(second)
+	dq.TryOffer(third)
+
+	popped := make(chan *fakeDelayed, 1)
+	go func() {
+		d, _ := dq.Pop(context.Background())
+		popped <- d
+	}()
+	// Pop等待first到期，删除first之后应当改为等待second
+	clk.BlockUntil(1)
+	if !dq.Remove(first) || dq.Contains(first) {
+		t.Fatal("expected first to be removed")
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	if d := <-popped; d != second {
+		t.Fatalf("expected second to be popped, got %s", d.name)
+	}
+
+	if n := dq.RemoveIf(func(d *fakeDelayed) bool { return d.name == "third" }); n != 1 {
+		t.Fatalf("expected third to be removed, got %d removals", n)
+	}
+	if dq.Contains(third) {
+		t.Error("expected the queue to be empty")
+	}
+
+	// 删除唯一的元素后，等待中的Pop被唤醒并停止定时器
+	last := &fakeDelayed{name: "last", exp: clk.Now().Add(time.Second), clock: clk}
+	dq.TryOffer(last)
+	go func() {
+		d, _ := dq.Pop(context.Background())
+		popped <- d
+	}()
+	clk.BlockUntil(1)
+	dq.Remove(last)
+	deadline := time.Now().Add(time.Second)
+	for clk.Waiters() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected waiting Pop to be signalled when its head is removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dq.Release()
+	if d := <-popped; d != nil {
+		t.Errorf("expected nothing to be popped, got %s", d.name)
+	}
+}
+
+func TestDelayQueueOf_DrainTo(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	if _, ok := dq.Peek(); ok || dq.Len() != 0 {
+		t.Fatal("expected an empty queue")
+	}
+	for i := 5; i >= 1; i-- {
+		dq.TryOffer(&fakeDelayed{name: time.Duration(i * int(time.Second)).String(), exp: clk.Now().Add(time.Duration(i) * time.Second), clock: clk})
+	}
+	if d, ok := dq.Peek(); !ok || d.name != "1s" || dq.Len() != 5 {
+		t.Fatalf("expected to peek 1s out of 5 elements, got %v of %d", d, dq.Len())
+	}
+
+	clk.Advance(3 * time.Second)
+	drained := dq.DrainTo(nil, 2)
+	if len(drained) != 2 || drained[0].name != "1s" || drained[1].name != "2s" {
+		t.Fatalf("expected 1s and 2s to be drained, got %v", drained)
+	}
+	drained = dq.DrainTo(drained, 0)
+	if len(drained) != 3 || drained[2].name != "3s" || dq.Len() != 2 {
+		t.Fatalf("expected 3s to be drained leaving 2 elements, got %d drained and %d left", len(drained), dq.Len())
+	}
+}
+
+func TestDelayQueueOf_PollTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	dq.TryOffer(&fakeDelayed{name: "2s", exp: clk.Now().Add(2 * time.Second), clock: clk})
+
+	type result struct {
+		d  *fakeDelayed
+		ok bool
+	}
+	results := make(chan result)
+	poll := func() {
+		d, ok := dq.PollTimeout(time.Second)
+		results <- result{d, ok}
+	}
+
+	// 超时先于元素到期
+	go poll()
+	clk.BlockUntil(2)
+	clk.Advance(time.Second)
+	if r := <-results; r.ok {
+		t.Fatalf("expected PollTimeout to time out, got %s", r.d.name)
+	}
+
+	go func() {
+		d, ok := dq.PollTimeout(2 * time.Second)
+		results <- result{d, ok}
+	}()
+	clk.BlockUntil(2)
+	clk.Advance(time.Second)
+	if r := <-results; !r.ok || r.d.name != "2s" || dq.Len() != 0 {
+		t.Fatalf("expected 2s to be polled, got %v", r)
+	}
+	if _, ok := dq.PollTimeout(0); ok {
+		t.Error("expected PollTimeout on an empty queue to fail")
+	}
+}
+
+// 取消之后Pop不再取出元素，即使堆顶已经到期
+func TestDelayQueueOf_PopCancelled(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	dq.TryOffer(&fakeDelayed{name: "late", exp: clk.Now().Add(time.Hour), clock: clk})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	popped := make(chan bool)
+	go func() {
+		_, ok := dq.Pop(ctx)
+		popped <- ok
+	}()
+	clk.BlockUntil(1)
+	// 堆顶到期但不通知leader，只有取消能唤醒Pop
+	dq.mu.Lock()
+	dq.q.locked(func(h *heapOf[*delayItem[*fakeDelayed]]) { h.items[0].exp = 0 })
+	dq.mu.Unlock()
+	cancel()
+	if <-popped || dq.Len() != 1 {
+		t.Fatalf("expected the cancelled Pop to leave the element, %d left", dq.Len())
+	}
+}
+
+func TestDelayQueueOf_EarlierOfferWakesPop(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	dq.TryOffer(&fakeDelayed{name: "hour", exp: clk.Now().Add(time.Hour), clock: clk})
+
+	popped := make(chan *fakeDelayed)
+	go func() {
+		d, _ := dq.Pop(context.Background())
+		popped <- d
+	}()
+	clk.BlockUntil(1)
+	// 新的堆顶重新设置等待中的定时器，而不是等待一小时
+	dq.TryOffer(&fakeDelayed{name: "second", exp: clk.Now().Add(time.Second), clock: clk})
+	clk.Advance(time.Second)
+	select {
+	case d := <-popped:
+		if d.name != "second" {
+			t.Fatalf("expected the earlier element to be popped, got %s", d.name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Pop to be woken up by an earlier element")
+	}
+	dq.Release()
+}
+
+func TestDelayQueueOf_ConcurrentPop(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk))
+	const consumers, elements = 4, 20
+
+	popped := make(chan *fakeDelayed)
+	for i := 0; i < consumers; i++ {
+		go func() {
+			for {
+				d, ok := dq.Pop(context.Background())
+				if !ok {
+					return
+				}
+				popped <- d
+			}
+		}()
+	}
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(elements) {
+		dq.TryOffer(&fakeDelayed{name: (time.Duration(i+1) * time.Second).String(), exp: clk.Now().Add(time.Duration(i+1) * time.Second), clock: clk})
+	}
+
+	for i := 1; i <= elements; i++ {
+		// 只有leader在时钟上等待，其余的调用方等待通知
+		clk.BlockUntil(1)
+		if n := clk.Waiters(); n != 1 {
+			t.Fatalf("expected only the leader to wait on the clock, got %d waiters", n)
+		}
+		clk.Advance(time.Second)
+		if d := <-popped; d.name != (time.Duration(i) * time.Second).String() {
+			t.Fatalf("expected %v to be popped, got %s", time.Duration(i)*time.Second, d.name)
+		}
+	}
+	dq.Release()
+}
+
+// countingMetrics 统计入队事件
+type countingMetrics struct {
+	accepted, blocked, full, closed int64
+}
+
+func (m *countingMetrics) OfferAccepted() { atomic.AddInt64(&m.accepted, 1) }
+func (m *countingMetrics) OfferBlocked()  { atomic.AddInt64(&m.blocked, 1) }
+func (m *countingMetrics) OfferRejected(err error) {
+	switch err {
+	case ErrQueueFull:
+		atomic.AddInt64(&m.full, 1)
+	case ErrQueueClosed:
+		atomic.AddInt64(&m.closed, 1)
+	}
+}
+
+func TestDelayQueueOf_Capacity(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	metrics := &countingMetrics{}
+	dq := NewDelayOf[*fakeDelayed](WithClock(clk), WithCapacity(2), WithMetrics(metrics))
+	newElement := func(name string) *fakeDelayed {
+		return &fakeDelayed{name: name, exp: clk.Now(), clock: clk}
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := dq.Offer(context.Background(), newElement(name)); err != nil {
+			t.Fatalf("expected %s to be accepted, got %v", name, err)
+		}
+	}
+	if err := dq.TryOffer(newElement("c")); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := dq.Offer(ctx, newElement("c")); err != ErrQueueFull {
+		t.Fatalf("expected Offer to fail once its context is done, got %v", err)
+	}
+
+	// 取出元素后，阻塞的Offer继续执行
+	offered := make(chan error)
+	go func() {
+		offered <- dq.Offer(context.Background(), newElement("d"))
+	}()
+	for atomic.LoadInt64(&metrics.blocked) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if d, ok := dq.Poll(); !ok || d.name != "a" {
+		t.Fatalf("expected a to be polled, got %v", d)
+	}
+	select {
+	case err := <-offered:
+		if err != nil || dq.Len() != 2 {
+			t.Fatalf("expected d to be accepted, got %v with %d elements", err, dq.Len())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the blocked Offer to proceed after Poll")
+	}
+
+	go func() {
+		offered <- dq.Offer(context.Background(), newElement("e"))
+	}()
+	for atomic.LoadInt64(&metrics.blocked) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	dq.Release()
+	if err := <-offered; err != ErrQueueClosed {
+		t.Errorf("expected the blocked Offer to fail with ErrQueueClosed, got %v", err)
+	}
+	if metrics.accepted != 3 || metrics.full != 2 || metrics.closed != 1 {
+		t.Errorf("unexpected metrics: %+v", *metrics)
+	}
+}
@@ -0,0 +1,645 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+)
+
+// Codec serializes the values of a DurableDelayQueue. A decoded value must
+// report the same expiration as the value that was encoded, so Delayed
+// values stored durably should keep an absolute deadline rather than a
+// relative delay.
+type Codec[T Delayed] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec is a Codec that uses encoding/json.
+type JSONCodec[T Delayed] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// durableConfig holds the settings given to OpenDurable.
+type durableConfig struct {
+	sync             bool
+	compactThreshold int
+	snapshotInterval time.Duration
+	queueOpts        []Option
+}
+
+// DurableOption configures a DurableDelayQueue.
+type DurableOption func(*durableConfig)
+
+// WithSync makes every write to the log wait for the data to reach the disk.
+// Without it a crash of the machine, as opposed to the process, may lose the
+// latest records.
+func WithSync() DurableOption {
+	return func(cfg *durableConfig) {
+		cfg.sync = true
+	}
+}
+
+// WithCompactThreshold sets how many removal records the log accumulates
+// before it is compacted, 1024 by default. The log is only compacted once it
+// also holds at least as many removed elements as live ones.
+func WithCompactThreshold(n int) DurableOption {
+	if n <= 0 {
+		panic("queue: compact threshold must be positive")
+	}
+	return func(cfg *durableConfig) {
+		cfg.compactThreshold = n
+	}
+}
+
+// WithSnapshotInterval compacts the log into a snapshot every d, measured by
+// the clock of the queue, if any element has been removed since the previous
+// compaction. It bounds the replay time of a queue whose removals stay below
+// the compact threshold.
+func WithSnapshotInterval(d time.Duration) DurableOption {
+	if d <= 0 {
+		panic("queue: snapshot interval must be positive")
+	}
+	return func(cfg *durableConfig) {
+		cfg.snapshotInterval = d
+	}
+}
+
+// WithQueueOptions sets the options of the in-memory DelayQueueOf, e.g.
+// WithClock or WithCapacity. The capacity is not enforced for the elements
+// replayed from the log.
+func WithQueueOptions(opts ...Option) DurableOption {
+	return func(cfg *durableConfig) {
+		cfg.queueOpts = append(cfg.queueOpts, opts...)
+	}
+}
+
+// 日志记录类型
+const (
+	recordOffer  byte = 1
+	recordRemove byte = 2
+)
+
+// 记录格式：类型(1) | 元素ID(8) | 数据长度(4) | 数据 | CRC32(4)，校验范围为CRC之前的所有字节
+const recordHeaderSize = 1 + 8 + 4
+
+// maxPayloadSize 单条记录数据长度的上限，读取时先检查长度字段，损坏的长度不会导致巨大的内存分配
+const maxPayloadSize = 64 << 20
+
+// ErrElementTooLarge is returned by the offers of a DurableDelayQueue when
+// the encoding of the element exceeds 64 MiB.
+var ErrElementTooLarge = errors.New("queue: encoded element too large")
+
+// DurableDelayQueue is a DelayQueueOf whose elements survive a restart of
+// the process. Every offer and removal is appended to a write-ahead log,
+// which is replayed by OpenDurable and compacted into a snapshot of the live
+// elements once enough removals have accumulated, or periodically with
+// WithSnapshotInterval.
+//
+// Delivery is at least once: an element taken right before a crash, or while
+// the queue is being closed, may be delivered again after the next
+// OpenDurable.
+type DurableDelayQueue[T Delayed] struct {
+	q         *DelayQueueOf[*durableItem[T]]
+	codec     Codec[T]
+	path      string
+	sync      bool
+	threshold int
+
+	mu     sync.Mutex // guards the log and the fields below
+	file   *os.File
+	nextID uint64
+	live   map[uint64][]byte // 未被取出的元素及其编码，用于压缩日志
+	dead   int               // 上次压缩之后的删除记录数
+	closed bool
+	err    error
+	stop   chan struct{} // Close时关闭，停止定时快照
+}
+
+// durableItem 队列中的元素及其在日志中的ID
+type durableItem[T Delayed] struct {
+	id    uint64
+	value T
+}
+
+func (i *durableItem[T]) GetDelay() time.Duration {
+	return i.value.GetDelay()
+}
+
+// OpenDurable opens the queue logged to the file at path, creating it if
+// needed, and restores the elements it holds. A record torn by a crash at
+// the end of the log is truncated away; any other damaged record fails the
+// open and leaves the log untouched.
+func OpenDurable[T Delayed](path string, codec Codec[T], opts ...DurableOption) (*DurableDelayQueue[T], error) {
+	cfg := durableConfig{compactThreshold: 1024}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	d := &DurableDelayQueue[T]{
+		q:         NewDelayOf[*durableItem[T]](cfg.queueOpts...),
+		codec:     codec,
+		path:      path,
+		sync:      cfg.sync,
+		threshold: cfg.compactThreshold,
+		nextID:    1,
+		live:      make(map[uint64][]byte),
+		stop:      make(chan struct{}),
+	}
+	good, torn, err := d.replay()
+	if err != nil {
+		return nil, err
+	}
+	ids := d.liveIDs()
+	d.q.mu.Lock()
+	for _, id := range ids {
+		v, err := codec.Decode(d.live[id])
+		if err != nil {
+			d.q.mu.Unlock()
+			return nil, fmt.Errorf("queue: decoding element %d of %s: %w", id, path, err)
+		}
+		d.q.push(&durableItem[T]{id: id, value: v})
+	}
+	d.q.mu.Unlock()
+	if torn {
+		// 丢弃了尾部时不压缩日志，只截断写了一半的记录，之后的记录接在完整的记录之后
+		if err := d.truncate(good); err != nil {
+			return nil, err
+		}
+	} else if err := d.compact(); err != nil {
+		// 重放之后立即写入快照，丢弃已删除的元素
+		return nil, err
+	}
+	if cfg.snapshotInterval > 0 {
+		delayCfg := delayConfig{clock: clock.System}
+		for _, opt := range cfg.queueOpts {
+			opt(&delayCfg)
+		}
+		go d.snapshotLoop(delayCfg.clock, cfg.snapshotInterval)
+	}
+	return d, nil
+}
+
+// snapshotLoop compacts the log every interval until the queue is closed.
+func (d *DurableDelayQueue[T]) snapshotLoop(clk clock.Clock, interval time.Duration) {
+	timer := clk.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-timer.C():
+		}
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		// 没有新的删除记录时日志已经是快照
+		if d.err == nil && d.dead > 0 {
+			if err := d.compact(); err != nil {
+				d.fail(err)
+			}
+		}
+		d.mu.Unlock()
+		timer.Reset(interval)
+	}
+}
+
+// replay reads the log into live. It returns the size of the intact part of
+// the log, and whether a record torn by a crash follows it.
+func (d *DurableDelayQueue[T]) replay() (int64, bool, error) {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		op, id, payload, err := readRecord(r)
+		if err == io.EOF {
+			return offset, false, nil
+		}
+		if err == errTornRecord {
+			// 只有崩溃时写了一半的最后一条记录可以丢弃；之后还有完整的记录，
+			// 说明是长度字段损坏，吞掉了日志的剩余部分
+			intact, rerr := intactRecordAfter(f, offset)
+			if rerr != nil {
+				return 0, false, rerr
+			}
+			if !intact {
+				return offset, true, nil
+			}
+			err = errCorruptRecord
+		}
+		if err == errCorruptRecord {
+			return 0, false, fmt.Errorf("queue: replaying %s: %w at offset %d", d.path, errCorruptRecord, offset)
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		offset += int64(recordHeaderSize + len(payload) + crc32.Size)
+		switch op {
+		case recordOffer:
+			d.live[id] = payload
+		case recordRemove:
+			delete(d.live, id)
+			d.dead++
+		}
+		if id >= d.nextID {
+			d.nextID = id + 1
+		}
+	}
+}
+
+// intactRecordAfter reports whether a complete record with a valid checksum
+// starts anywhere in f after the record at offset.
+func intactRecordAfter(f *os.File, offset int64) (bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	// 写了一半的记录不会比最长的记录更长
+	if info.Size()-offset > recordHeaderSize+maxPayloadSize+crc32.Size {
+		return true, nil
+	}
+	rest, err := io.ReadAll(io.NewSectionReader(f, offset+1, info.Size()-offset-1))
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i+recordHeaderSize+crc32.Size <= len(rest); i++ {
+		size := binary.BigEndian.Uint32(rest[i+9 : i+13])
+		if int64(size) > int64(len(rest)-i-recordHeaderSize-crc32.Size) {
+			continue
+		}
+		if _, _, _, err := readRecord(bytes.NewReader(rest[i:])); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var (
+	errCorruptRecord = errors.New("queue: corrupt log record")
+	errTornRecord    = errors.New("queue: torn log record")
+)
+
+// readRecord reads the next record of the log. It returns io.EOF at the end
+// of the log, errTornRecord for a record cut short by the end of the log, and
+// errCorruptRecord for a damaged record, or one longer than maxPayloadSize,
+// which is rejected before anything is allocated.
+func readRecord(r io.Reader) (byte, uint64, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return 0, 0, nil, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return 0, 0, nil, errTornRecord
+		}
+		return 0, 0, nil, err
+	}
+	op, id, size := header[0], binary.BigEndian.Uint64(header[1:9]), binary.BigEndian.Uint32(header[9:13])
+	if size > maxPayloadSize {
+		return 0, 0, nil, errCorruptRecord
+	}
+	rest := make([]byte, int(size)+crc32.Size)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, 0, nil, errTornRecord
+		}
+		return 0, 0, nil, err
+	}
+	payload, sum := rest[:len(rest)-crc32.Size], rest[len(rest)-crc32.Size:]
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(payload)
+	if crc.Sum32() != binary.BigEndian.Uint32(sum) || (op != recordOffer && op != recordRemove) {
+		return 0, 0, nil, errCorruptRecord
+	}
+	return op, id, payload, nil
+}
+
+// appendRecord appends the encoding of a record to buf.
+func appendRecord(buf []byte, op byte, id uint64, payload []byte) []byte {
+	start := len(buf)
+	var header [recordHeaderSize]byte
+	header[0] = op
+	binary.BigEndian.PutUint64(header[1:9], id)
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+	buf = append(buf, header[:]...)
+	buf = append(buf, payload...)
+	var sum [crc32.Size]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf[start:]))
+	return append(buf, sum[:]...)
+}
+
+// liveIDs returns the IDs of the live elements in the order they were offered.
+func (d *DurableDelayQueue[T]) liveIDs() []uint64 {
+	ids := make([]uint64, 0, len(d.live))
+	for id := range d.live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Compact rewrites the log as a snapshot of the live elements.
+func (d *DurableDelayQueue[T]) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrQueueClosed
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return d.compact()
+}
+
+// compact writes the live elements to a new file that atomically replaces
+// the log. It must be called with mu held.
+func (d *DurableDelayQueue[T]) compact() error {
+	tmp := d.path + ".tmp"
+	var buf []byte
+	for _, id := range d.liveIDs() {
+		buf = appendRecord(buf, recordOffer, id, d.live[id])
+	}
+	if err := writeFileSync(tmp, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(d.path))
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file = f
+	d.dead = 0
+	return nil
+}
+
+// truncate cuts the log down to its first size bytes, dropping a torn
+// record, and opens it for appending.
+func (d *DurableDelayQueue[T]) truncate(size int64) error {
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	d.file = f
+	return nil
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable, where the platform supports it.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
+
+// write appends a record to the log. It must be called with mu held.
+func (d *DurableDelayQueue[T]) write(op byte, id uint64, payload []byte) error {
+	if _, err := d.file.Write(appendRecord(nil, op, id, payload)); err != nil {
+		return d.fail(err)
+	}
+	if d.sync {
+		if err := d.file.Sync(); err != nil {
+			return d.fail(err)
+		}
+	}
+	return nil
+}
+
+// fail records the first error writing the log; the queue accepts no offer
+// after it. It must be called with mu held.
+func (d *DurableDelayQueue[T]) fail(err error) error {
+	if d.err == nil {
+		d.err = fmt.Errorf("queue: writing %s: %w", d.path, err)
+	}
+	return d.err
+}
+
+// Err returns the first error that occurred writing the log, if any. Once it
+// is set, offers fail with it and removals are no longer recorded.
+func (d *DurableDelayQueue[T]) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// logOffer records the offer of v before it is added to the queue.
+func (d *DurableDelayQueue[T]) logOffer(v T) (*durableItem[T], error) {
+	payload, err := d.codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxPayloadSize {
+		return nil, ErrElementTooLarge
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrQueueClosed
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	id := d.nextID
+	if err := d.write(recordOffer, id, payload); err != nil {
+		return nil, err
+	}
+	d.nextID++
+	d.live[id] = payload
+	return &durableItem[T]{id: id, value: v}, nil
+}
+
+// logRemove records that the elements left the queue, and compacts the log
+// once enough removals have accumulated.
+func (d *DurableDelayQueue[T]) logRemove(items ...*durableItem[T]) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || d.err != nil {
+		return
+	}
+	for _, item := range items {
+		if d.write(recordRemove, item.id, nil) != nil {
+			return
+		}
+		delete(d.live, item.id)
+		d.dead++
+	}
+	if d.dead >= d.threshold && d.dead >= len(d.live) {
+		if err := d.compact(); err != nil {
+			d.fail(err)
+		}
+	}
+}
+
+// Offer logs e and adds it to the queue, waiting for room until ctx is done,
+// see DelayQueueOf.Offer.
+func (d *DurableDelayQueue[T]) Offer(ctx context.Context, e T) error {
+	item, err := d.logOffer(e)
+	if err != nil {
+		return err
+	}
+	if err := d.q.Offer(ctx, item); err != nil {
+		d.logRemove(item)
+		return err
+	}
+	return nil
+}
+
+// TryOffer logs e and adds it to the queue without waiting, see
+// DelayQueueOf.TryOffer.
+func (d *DurableDelayQueue[T]) TryOffer(e T) error {
+	item, err := d.logOffer(e)
+	if err != nil {
+		return err
+	}
+	if err := d.q.TryOffer(item); err != nil {
+		d.logRemove(item)
+		return err
+	}
+	return nil
+}
+
+// Pop waits for the head of the queue to expire, removes it and logs the
+// removal, see DelayQueueOf.Pop.
+func (d *DurableDelayQueue[T]) Pop(ctx context.Context) (T, bool) {
+	return d.taken(d.q.Pop(ctx))
+}
+
+// Poll removes the head of the queue if it has expired, see
+// DelayQueueOf.Poll.
+func (d *DurableDelayQueue[T]) Poll() (T, bool) {
+	return d.taken(d.q.Poll())
+}
+
+// PollTimeout waits up to d for the head of the queue to expire, see
+// DelayQueueOf.PollTimeout.
+func (d *DurableDelayQueue[T]) PollTimeout(timeout time.Duration) (T, bool) {
+	return d.taken(d.q.PollTimeout(timeout))
+}
+
+func (d *DurableDelayQueue[T]) taken(item *durableItem[T], ok bool) (T, bool) {
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	d.logRemove(item)
+	return item.value, true
+}
+
+// DrainTo removes the expired elements and appends them to dst, see
+// DelayQueueOf.DrainTo.
+func (d *DurableDelayQueue[T]) DrainTo(dst []T, max int) []T {
+	items := d.q.DrainTo(nil, max)
+	if len(items) > 0 {
+		d.logRemove(items...)
+	}
+	for _, item := range items {
+		dst = append(dst, item.value)
+	}
+	return dst
+}
+
+// RemoveIf removes every element for which f returns true and returns the
+// number of elements removed, see DelayQueueOf.RemoveIf.
+func (d *DurableDelayQueue[T]) RemoveIf(f func(T) bool) int {
+	var removed []*durableItem[T]
+	d.q.RemoveIf(func(item *durableItem[T]) bool {
+		if f(item.value) {
+			removed = append(removed, item)
+			return true
+		}
+		return false
+	})
+	if len(removed) > 0 {
+		d.logRemove(removed...)
+	}
+	return len(removed)
+}
+
+// Peek returns the head of the queue without removing it, see
+// DelayQueueOf.Peek.
+func (d *DurableDelayQueue[T]) Peek() (T, bool) {
+	if item, ok := d.q.Peek(); ok {
+		return item.value, true
+	}
+	var zero T
+	return zero, false
+}
+
+// Len returns the number of elements in the queue.
+func (d *DurableDelayQueue[T]) Len() int {
+	return d.q.Len()
+}
+
+// Close closes the log and releases the in-memory queue; the pending
+// elements stay in the log for the next OpenDurable. Goroutines blocked in
+// Pop are woken up, later offers fail with ErrQueueClosed.
+func (d *DurableDelayQueue[T]) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.stop)
+	d.q.Release()
+	return d.file.Close()
+}
@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+)
+
+// message 按绝对时间到期，编码之后不丢失到期时间
+type message struct {
+	Body     string
+	Deadline time.Time
+}
+
+func (m *message) GetDelay() time.Duration {
+	return time.Until(m.Deadline)
+}
+
+func openMessages(t *testing.T, path string, opts ...DurableOption) *DurableDelayQueue[*message] {
+	t.Helper()
+	dq, err := OpenDurable[*message](path, JSONCodec[*message]{}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dq
+}
+
+func TestDurableDelayQueue_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+
+	dq := openMessages(t, path)
+	dq.TryOffer(&message{Body: "a", Deadline: past.Add(-time.Second)})
+	dq.TryOffer(&message{Body: "b", Deadline: past})
+	dq.TryOffer(&message{Body: "c", Deadline: future})
+	if m, ok := dq.Poll(); !ok || m.Body != "a" {
+		t.Fatalf("expected a to be polled, got %v", m)
+	}
+	if err := dq.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dq.TryOffer(&message{Body: "d"}); err != ErrQueueClosed {
+		t.Fatalf("expected ErrQueueClosed after Close, got %v", err)
+	}
+
+	// 重新打开后恢复未取出的元素
+	dq = openMessages(t, path)
+	if dq.Len() != 2 {
+		t.Fatalf("expected 2 elements after replay, got %d", dq.Len())
+	}
+	if m, ok := dq.Poll(); !ok || m.Body != "b" {
+		t.Fatalf("expected b to be polled, got %v", m)
+	}
+	if m, ok := dq.Peek(); !ok || m.Body != "c" || !m.Deadline.Equal(future) {
+		t.Fatalf("expected c to be pending until %v, got %v", future, m)
+	}
+	dq.Close()
+
+	// 崩溃时写了一半的记录被丢弃
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	f.Write(appendRecord(nil, recordRemove, 3, nil)[:5])
+	f.Close()
+	dq = openMessages(t, path)
+	if m, ok := dq.Peek(); !ok || m.Body != "c" || dq.Len() != 1 {
+		t.Fatalf("expected only c after a torn write, got %v of %d", m, dq.Len())
+	}
+	// 只截断写了一半的记录，不压缩日志；之后的记录接在完整的记录之后
+	if after, err := os.Stat(path); err != nil || after.Size() != info.Size() {
+		t.Fatalf("expected the log to be truncated to %d bytes, got %v", info.Size(), after)
+	}
+	dq.TryOffer(&message{Body: "e", Deadline: future})
+	dq.Close()
+	dq = openMessages(t, path)
+	defer dq.Close()
+	if dq.Len() != 2 {
+		t.Fatalf("expected c and e after reopening, got %d elements", dq.Len())
+	}
+}
+
+func TestDurableDelayQueue_CorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	dq := openMessages(t, path)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		dq.TryOffer(&message{Body: body, Deadline: time.Now().Add(time.Hour)})
+	}
+	dq.Close()
+
+	// 损坏第一条记录的数据，之后的记录完好
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDurable[*message](path, JSONCodec[*message]{}); !errors.Is(err, errCorruptRecord) {
+		t.Fatalf("expected a corrupt record error, got %v", err)
+	}
+	// 日志没有被压缩
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, data) {
+		t.Fatalf("expected the log to be left untouched, got %d bytes (was %d)", len(after), len(data))
+	}
+}
+
+func TestDurableDelayQueue_CorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	dq := openMessages(t, path)
+	// 到期时间相同，每条记录一样长
+	deadline := time.Now().Add(time.Hour)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		dq.TryOffer(&message{Body: body, Deadline: deadline})
+	}
+	dq.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := len(data) / 4
+
+	for _, c := range []struct {
+		name   string
+		offset int
+		size   uint32
+	}{
+		// 长度超出文件末尾，第二条记录吞掉了之后的记录
+		{"past the end", recordSize + 9, uint32(len(data))},
+		// 长度仍在文件内，记录完整但校验和不符
+		{"within the log", recordSize + 9, uint32(recordSize)},
+		// 最后一条记录完整但校验和不符，不是写了一半的记录
+		{"last record", 3*recordSize + 9, uint32(recordSize - recordHeaderSize - crc32.Size - 1)},
+	} {
+		corrupt := append([]byte(nil), data...)
+		binary.BigEndian.PutUint32(corrupt[c.offset:c.offset+4], c.size)
+		if err := os.WriteFile(path, corrupt, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenDurable[*message](path, JSONCodec[*message]{}); !errors.Is(err, errCorruptRecord) {
+			t.Fatalf("%s: expected a corrupt record error, got %v", c.name, err)
+		}
+		if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, corrupt) {
+			t.Fatalf("%s: expected the log to be left untouched, got %d bytes (was %d)", c.name, len(after), len(corrupt))
+		}
+	}
+}
+
+func TestReadRecord_Oversized(t *testing.T) {
+	record := appendRecord(nil, recordOffer, 1, []byte("payload"))
+	// 长度字段被改为4GB，读取时不应按此分配内存
+	binary.BigEndian.PutUint32(record[9:13], 0xffffffff)
+	if _, _, _, err := readRecord(bytes.NewReader(record)); err != errCorruptRecord {
+		t.Fatalf("expected errCorruptRecord for an oversized record, got %v", err)
+	}
+}
+
+func TestDurableDelayQueue_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	dq := openMessages(t, path, WithSync(), WithCompactThreshold(4))
+	defer dq.Close()
+	past := time.Now().Add(-time.Minute)
+	keep := &message{Body: "keep", Deadline: time.Now().Add(time.Hour)}
+	dq.TryOffer(keep)
+	for i := 0; i < 3; i++ {
+		dq.TryOffer(&message{Body: "drop", Deadline: past})
+	}
+	if drained := dq.DrainTo(nil, 0); len(drained) != 3 {
+		t.Fatalf("expected 3 elements to be drained, got %d", len(drained))
+	}
+	if n := dq.RemoveIf(func(m *message) bool { return m.Body == "nothing" }); n != 0 {
+		t.Fatalf("expected nothing to be removed, got %d", n)
+	}
+	sizeOf := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	before := sizeOf()
+
+	// 第四条删除记录触发压缩，日志只剩下keep
+	dq.TryOffer(&message{Body: "drop", Deadline: past})
+	if n := dq.RemoveIf(func(m *message) bool { return m.Body == "drop" }); n != 1 {
+		t.Fatalf("expected 1 element to be removed, got %d", n)
+	}
+	payload, _ := JSONCodec[*message]{}.Encode(keep)
+	if size := sizeOf(); size != int64(len(appendRecord(nil, recordOffer, 1, payload))) || size >= before {
+		t.Fatalf("expected the log to be compacted to a snapshot of keep, got %d bytes (was %d)", size, before)
+	}
+	if err := dq.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDurableDelayQueue_SnapshotInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	clk := clock.NewFake(time.Now())
+	dq := openMessages(t, path, WithSnapshotInterval(time.Minute), WithQueueOptions(WithClock(clk)))
+	defer dq.Close()
+	keep := &message{Body: "keep", Deadline: time.Now().Add(time.Hour)}
+	dq.TryOffer(keep)
+	dq.TryOffer(&message{Body: "drop", Deadline: time.Now().Add(-time.Minute)})
+	if m, ok := dq.Poll(); !ok || m.Body != "drop" {
+		t.Fatalf("expected drop to be polled, got %v", m)
+	}
+
+	// 删除记录远少于压缩阈值，由定时快照压缩日志
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := JSONCodec[*message]{}.Encode(keep)
+	if size := info.Size(); size != int64(len(appendRecord(nil, recordOffer, 1, payload))) {
+		t.Fatalf("expected the log to be compacted to a snapshot of keep, got %d bytes", size)
+	}
+}
@@ -2,87 +2,279 @@ package queue
 
 import (
 	"container/heap"
+	"fmt"
+	"reflect"
 	"sync"
 )
 
-// An Item is something we manage in a priority queue.
-type Item struct {
-	Value    interface{}  // The value of the item; arbitrary.
-	Priority func() int64 // The priority of the item in the queue.
-	index    int          // The index of the item in the heap. The index is needed by update and is maintained by the heap.Interface methods.
+// Indexed is implemented by values that keep track of their position in a
+// queue, which lets Fix, Contains and Remove find them in O(1) instead of
+// comparing every queued value. A value can be in only one queue at a time.
+type Indexed interface {
+	// Index returns the index last set by SetIndex.
+	Index() int
+	// SetIndex is called by the queue whenever the value moves, with -1 once
+	// it has left the queue.
+	SetIndex(i int)
 }
 
-func (i *Item) Index() int {
-	return i.index
+// PriorityQueueOf is a priority queue of values of type T. Pop returns the
+// value that sorts first according to the comparator the queue was created
+// with. It is safe for concurrent use.
+type PriorityQueueOf[T any] struct {
+	mu sync.Mutex
+	h  heapOf[T]
+}
+
+// NewPriorityOf returns an empty queue ordered by less, which reports whether
+// a must be popped before b. Values implementing Indexed are told their index.
+func NewPriorityOf[T any](less func(a, b T) bool) *PriorityQueueOf[T] {
+	return &PriorityQueueOf[T]{h: heapOf[T]{less: less, setIndex: setIndexOf[T]}}
 }
 
-// A priorityQueue implements heap.Interface and holds Items.
-type priorityQueue struct {
-	items    []*Item
-	newItems []*Item
-	delItem  *Item
+// Init replaces the content of the queue with the given values, in O(n).
+func (pq *PriorityQueueOf[T]) Init(values []T) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.h.items = append(pq.h.items[:0], values...)
+	for i := range pq.h.items {
+		pq.h.moved(i)
+	}
+	heap.Init(&pq.h)
+}
+
+func (pq *PriorityQueueOf[T]) Len() int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	return len(pq.h.items)
 }
 
-func (pq priorityQueue) Len() int { return len(pq.items) }
+func (pq *PriorityQueueOf[T]) Push(v T) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	heap.Push(&pq.h, v)
+}
 
-func (pq priorityQueue) Less(i, j int) bool {
-	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-	// 这边跟heap包中的不同，这里希望返回Priority最小的
-	return pq.items[i].Priority() < pq.items[j].Priority()
+// Pop 获取第一个元素，并删除；队列为空时返回false
+func (pq *PriorityQueueOf[T]) Pop() (T, bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if len(pq.h.items) == 0 {
+		var zero T
+		return zero, false
+	}
+	return heap.Pop(&pq.h).(T), true
 }
 
-func (pq priorityQueue) Swap(i, j int) {
-	if pq.Len() > 1 {
-		pq.items[i], pq.items[j] = pq.items[j], pq.items[i]
-		pq.items[i].index = i
-		pq.items[j].index = j
+// Peek 获取第一个元素，但不删除；队列为空时返回false。堆顶即第一个元素，O(1)
+func (pq *PriorityQueueOf[T]) Peek() (T, bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if len(pq.h.items) == 0 {
+		var zero T
+		return zero, false
 	}
+	return pq.h.items[0], true
 }
 
-func (pq *priorityQueue) Push(x interface{}) {
-	n := len(pq.items)
-	item := x.(*Item)
-	item.index = n
-	pq.items = append(pq.items, item)
+// Fix re-establishes the ordering after the priority of v changed, in
+// O(log n), and reports whether v was found in the queue. v must implement
+// Indexed.
+func (pq *PriorityQueueOf[T]) Fix(v T) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if i := pq.h.indexOf(v); i >= 0 {
+		heap.Fix(&pq.h, i)
+		return true
+	}
+	return false
+}
+
+// Contains reports whether v is in the queue, in O(1). v must implement
+// Indexed.
+func (pq *PriorityQueueOf[T]) Contains(v T) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	return pq.h.indexOf(v) >= 0
 }
 
-func (pq *priorityQueue) Pop() interface{} {
-	if len(pq.items) == 0 {
-		return nil
+// Remove removes v from the queue in O(log n) and reports whether it was
+// found. v must implement Indexed.
+func (pq *PriorityQueueOf[T]) Remove(v T) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if i := pq.h.indexOf(v); i >= 0 {
+		heap.Remove(&pq.h, i)
+		return true
 	}
-	old := pq.items
-	n := len(old)
-	item := old[n-1]
-	pq.delItem = item
-	pq.newItems = old[0 : n-1]
-	return item
+	return false
+}
+
+// RemoveIf removes every value for which f returns true, in O(n), and
+// returns the number of values removed.
+func (pq *PriorityQueueOf[T]) RemoveIf(f func(T) bool) int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	return pq.h.removeIf(f)
 }
 
-func (pq *priorityQueue) remove() {
-	if pq.delItem != nil && pq.newItems != nil {
-		old := pq.items
-		n := len(old)
-		item := old[n-1]
-		if pq.delItem != item {
-			return
+func (pq *PriorityQueueOf[T]) Clear() {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	for _, v := range pq.h.items {
+		if pq.h.setIndex != nil {
+			pq.h.setIndex(v, -1)
 		}
-		old[n-1] = nil  // avoid memory leak
-		item.index = -1 // for safety
-		pq.delItem = nil
-		pq.items = pq.newItems
-		pq.newItems = nil
 	}
+	pq.h.items = nil
+}
+
+// locked calls f with the queue locked, so that f can change values in
+// place and re-establish the ordering with heap.Fix.
+func (pq *PriorityQueueOf[T]) locked(f func(h *heapOf[T])) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	f(&pq.h)
+}
+
+// heapOf implements heap.Interface over a slice of T. The optional setIndex
+// hook is told the new index of every value that moves, -1 once popped.
+type heapOf[T any] struct {
+	items    []T
+	less     func(a, b T) bool
+	setIndex func(v T, i int)
+}
+
+func (h *heapOf[T]) Len() int { return len(h.items) }
+
+func (h *heapOf[T]) Less(i, j int) bool {
+	return h.less(h.items[i], h.items[j])
+}
+
+func (h *heapOf[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.moved(i)
+	h.moved(j)
+}
+
+func (h *heapOf[T]) Push(x interface{}) {
+	h.items = append(h.items, x.(T))
+	h.moved(len(h.items) - 1)
+}
+
+func (h *heapOf[T]) Pop() interface{} {
+	n := len(h.items)
+	v := h.items[n-1]
+	var zero T
+	h.items[n-1] = zero // avoid memory leak
+	h.items = h.items[:n-1]
+	if h.setIndex != nil {
+		h.setIndex(v, -1) // for safety
+	}
+	return v
 }
 
-// update modifies the priority and value of an Item in the queue.
-func (pq *priorityQueue) update(item *Item, value interface{}, priority func() int64) {
-	item.Value = value
-	item.Priority = priority
-	heap.Fix(pq, item.index)
+// indexOf returns the index of v in the heap, or -1. v must implement
+// Indexed.
+func (h *heapOf[T]) indexOf(v T) int {
+	i := indexed(v).Index()
+	if i >= 0 && i < len(h.items) && sameValue(h.items[i], v) {
+		return i
+	}
+	return -1
+}
+
+// removeIf removes the values matching f and restores the heap ordering.
+func (h *heapOf[T]) removeIf(f func(T) bool) int {
+	kept := h.items[:0]
+	removed := 0
+	for _, v := range h.items {
+		if f(v) {
+			removed++
+			if h.setIndex != nil {
+				h.setIndex(v, -1)
+			}
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	var zero T
+	for i := len(kept); i < len(h.items); i++ {
+		h.items[i] = zero // avoid memory leak
+	}
+	h.items = kept
+	for i := range h.items {
+		h.moved(i)
+	}
+	heap.Init(h)
+	return removed
+}
+
+func (h *heapOf[T]) moved(i int) {
+	if h.setIndex != nil {
+		h.setIndex(h.items[i], i)
+	}
+}
+
+// setIndexOf tells v its index if it implements Indexed.
+func setIndexOf[T any](v T, i int) {
+	if x, ok := any(v).(Indexed); ok {
+		x.SetIndex(i)
+	}
+}
+
+// indexed returns v as an Indexed, and panics if it is not one.
+func indexed(v interface{}) Indexed {
+	x, ok := v.(Indexed)
+	if !ok {
+		panic(fmt.Sprintf("queue: %T does not implement Indexed", v))
+	}
+	return x
+}
+
+// sameValue reports whether a and b are the same value. Unlike ==, it does
+// not panic on values whose dynamic type is not comparable; such values are
+// never the same.
+func sameValue(a, b interface{}) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb || (ta != nil && !ta.Comparable()) {
+		return false
+	}
+	return a == b
+}
+
+// An Item is something we manage in a priority queue. Priority is evaluated
+// once when the item is pushed, and again only by Update and Fix.
+type Item struct {
+	Value    interface{}  // The value of the item; arbitrary.
+	Priority func() int64 // The priority of the item in the queue.
+	index    int          // The index of the item in the heap. The index is needed by update and is maintained by the heap.Interface methods.
+	key      int64        // The cached result of Priority, compared by the heap.
+}
+
+// Index returns the position of the item in the heap, or -1 once it has been
+// popped. It changes whenever the queue is modified.
+func (i *Item) Index() int {
+	return i.index
+}
+
+// 这边跟heap包中的不同，这里希望返回Priority最小的
+func itemLess(a, b *Item) bool {
+	return a.key < b.key
+}
+
+// inQueue reports whether item is in the heap h.
+func inQueue(h *heapOf[*Item], item *Item) bool {
+	return item.index >= 0 && item.index < h.Len() && h.items[item.index] == item
 }
 
 func NewPriority() *PriorityQueue {
-	return &PriorityQueue{}
+	pq := &PriorityQueue{queue: NewPriorityOf(itemLess)}
+	pq.queue.h.setIndex = func(item *Item, i int) { item.index = i }
+	return pq
 }
 
 func NewPriorityFromSlice(s []*Item) *PriorityQueue {
@@ -91,55 +283,105 @@ func NewPriorityFromSlice(s []*Item) *PriorityQueue {
 	return pq
 }
 
+// PriorityQueue is a queue of *Item ordered by ascending Priority, kept for
+// callers of the untyped API; it wraps a PriorityQueueOf[*Item] and is safe
+// for concurrent use.
 type PriorityQueue struct {
-	mu    sync.Mutex
-	queue priorityQueue
+	queue *PriorityQueueOf[*Item]
 }
 
+// InitFromSlice adds the items to the queue.
 func (pq *PriorityQueue) InitFromSlice(s []*Item) {
-	pq.queue.items = append(pq.queue.items, s...)
-	pq.init()
-}
-
-func (pq *PriorityQueue) init() {
-	heap.Init(&pq.queue)
+	pq.queue.locked(func(h *heapOf[*Item]) {
+		for _, item := range s {
+			item.key = item.Priority()
+		}
+		h.items = append(h.items, s...)
+		for i := range h.items {
+			h.moved(i)
+		}
+		heap.Init(h)
+	})
 }
 
 func (pq *PriorityQueue) Len() int {
-	return len(pq.queue.items)
+	return pq.queue.Len()
 }
 
 func (pq *PriorityQueue) Push(x interface{}) {
-	heap.Push(&pq.queue, x)
+	item := x.(*Item)
+	item.key = item.Priority()
+	pq.queue.Push(item)
 }
 
 // Pop 获取第一个元素，并删除
 func (pq *PriorityQueue) Pop() interface{} {
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
-	if pq.Len() == 0 {
-		return nil
+	if item, ok := pq.queue.Pop(); ok {
+		return item
 	}
-	item := heap.Pop(&pq.queue)
-	pq.queue.remove()
-	return item
+	return nil
 }
 
 //Peek 获取第一个元素，但不删除
 func (pq *PriorityQueue) Peek() interface{} {
-	pq.mu.Lock()
-	defer pq.mu.Unlock()
-	item := heap.Pop(&pq.queue)
-	pq.queue.delItem = nil
-	pq.queue.newItems = nil
-	pq.queue.Swap(0, pq.Len()-1)
-	return item
+	if item, ok := pq.queue.Peek(); ok {
+		return item
+	}
+	return nil
 }
 
+// Update modifies the priority and value of an Item in the queue. An item
+// that is no longer in the queue is only modified.
 func (pq *PriorityQueue) Update(item *Item, value interface{}, priority func() int64) {
-	pq.queue.update(item, value, priority)
+	pq.queue.locked(func(h *heapOf[*Item]) {
+		item.Value = value
+		item.Priority = priority
+		item.key = priority()
+		if inQueue(h, item) {
+			heap.Fix(h, item.index)
+		}
+	})
+}
+
+// Fix re-evaluates the Priority of an item in the queue, e.g. after the data
+// it reads has changed, and moves the item accordingly.
+func (pq *PriorityQueue) Fix(item *Item) {
+	pq.queue.locked(func(h *heapOf[*Item]) {
+		item.key = item.Priority()
+		if inQueue(h, item) {
+			heap.Fix(h, item.index)
+		}
+	})
+}
+
+// Contains reports whether the item is in the queue, in O(1).
+func (pq *PriorityQueue) Contains(item *Item) bool {
+	contains := false
+	pq.queue.locked(func(h *heapOf[*Item]) {
+		contains = inQueue(h, item)
+	})
+	return contains
+}
+
+// Remove removes the item from the queue in O(log n), and reports whether it
+// was in the queue.
+func (pq *PriorityQueue) Remove(item *Item) bool {
+	removed := false
+	pq.queue.locked(func(h *heapOf[*Item]) {
+		if inQueue(h, item) {
+			heap.Remove(h, item.index)
+			removed = true
+		}
+	})
+	return removed
+}
+
+// RemoveIf removes every *Item for which f returns true and returns the
+// number of items removed.
+func (pq *PriorityQueue) RemoveIf(f func(interface{}) bool) int {
+	return pq.queue.RemoveIf(func(item *Item) bool { return f(item) })
 }
 
 func (pq *PriorityQueue) Clear() {
-	pq.queue.items = nil
+	pq.queue.Clear()
 }
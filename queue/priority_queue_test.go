@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"sync"
 	"testing"
 )
 
@@ -16,9 +17,10 @@ func TestPriorityQueue_Pop(t *testing.T) {
 	source := make([]*Item, len(items))
 	i := 0
 	for value, priority := range items {
+		priority := priority
 		source[i] = &Item{
 			Value:    value,
-			Priority: priority,
+			Priority: func() int64 { return priority },
 		}
 		i++
 	}
@@ -28,24 +30,268 @@ func TestPriorityQueue_Pop(t *testing.T) {
 	// Insert a new item and then modify its priority.
 	item := &Item{
 		Value:    "orange",
-		Priority: 1,
+		Priority: func() int64 { return 1 },
 	}
 	pq.Push(item)
-	pq.Update(item, item.Value, 9)
+	pq.Update(item, item.Value, func() int64 { return 9 })
 
 	item = pq.Peek().(*Item)
-	t.Logf("11111111111111111   %.2d:%s ", item.Priority, item.Value)
+	t.Logf("11111111111111111   %.2d:%s ", item.Priority(), item.Value)
 	item = pq.Pop().(*Item)
-	t.Logf("22222222222222222   %.2d:%s ", item.Priority, item.Value)
+	t.Logf("22222222222222222   %.2d:%s ", item.Priority(), item.Value)
 	// Take the items out; they arrive in decreasing priority order.
 	for pq.Len() > 0 {
 		item := pq.Pop().(*Item)
-		t.Logf("%.2d:%s ", item.Priority, item.Value)
+		t.Logf("%.2d:%s ", item.Priority(), item.Value)
 	}
 
 	if item, ok := pq.Pop().(*Item); ok {
-		t.Logf("%.2d:%s ", item.Priority, item.Value)
+		t.Logf("%.2d:%s ", item.Priority(), item.Value)
 	}
 	// Output:
 	// 05:orange 04:pear 03:banana 02:apple
 }
+
+func TestPriorityQueueOf(t *testing.T) {
+	// 按长度排序，长度相同时按字典序
+	pq := NewPriorityOf(func(a, b string) bool {
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	pq.Init([]string{"banana", "fig", "apple", "kiwi"})
+	pq.Push("pear")
+	if v, ok := pq.Peek(); !ok || v != "fig" || pq.Len() != 5 {
+		t.Fatalf("expected to peek fig out of 5 values, got %q of %d", v, pq.Len())
+	}
+	var got []string
+	for {
+		v, ok := pq.Pop()
+		if !ok {
+			break
+		}
+		got = append(got, v)
+	}
+	expected := []string{"fig", "kiwi", "pear", "apple", "banana"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+	if _, ok := pq.Peek(); ok {
+		t.Error("expected Peek on an empty queue to return false")
+	}
+}
+
+func TestPriorityQueue_Update(t *testing.T) {
+	pq := NewPriority()
+	items := make([]*Item, 5)
+	for i := range items {
+		priority := int64(i)
+		items[i] = &Item{Value: i, Priority: func() int64 { return priority }}
+		pq.Push(items[i])
+	}
+	pq.Update(items[4], "first", func() int64 { return -1 })
+	if item := pq.Peek().(*Item); item != items[4] || item.Index() != 0 {
+		t.Fatalf("expected updated item at the head, got %v at %d", item.Value, item.Index())
+	}
+	if item := pq.Pop().(*Item); item.Value != "first" || item.Index() != -1 {
+		t.Errorf("expected popped item to be detached, got %v at %d", item.Value, item.Index())
+	}
+}
+
+// 并发Push/Pop/Peek/Update，由-race检查数据竞争
+func TestPriorityQueue_Concurrent(t *testing.T) {
+	pq := NewPriority()
+	const workers, perWorker = 8, 200
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	popped := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				priority := int64(w*perWorker + i)
+				item := &Item{Value: priority, Priority: func() int64 { return priority }}
+				pq.Push(item)
+				pq.Update(item, item.Value, func() int64 { return -priority })
+				pq.Peek()
+				pq.Len()
+				if i%2 == 0 && pq.Pop() != nil {
+					mu.Lock()
+					popped++
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if popped+pq.Len() != workers*perWorker {
+		t.Fatalf("expected %d items popped or queued, got %d popped and %d queued", workers*perWorker, popped, pq.Len())
+	}
+	last := int64(-1 << 62)
+	for pq.Len() > 0 {
+		p := pq.Pop().(*Item).Priority()
+		if p < last {
+			t.Fatalf("expected ascending priorities, got %d after %d", p, last)
+		}
+		last = p
+	}
+}
+
+func TestPriorityQueueOf_Concurrent(t *testing.T) {
+	pq := NewPriorityOf(func(a, b int) bool { return a < b })
+	const workers, perWorker = 8, 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				pq.Push(w*perWorker + i)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				pq.Peek()
+				pq.Len()
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < workers*perWorker; i++ {
+		if v, ok := pq.Pop(); !ok || v != i {
+			t.Fatalf("expected %d to be popped, got %d (%v)", i, v, ok)
+		}
+	}
+}
+
+func TestPriorityQueue_CachedPriority(t *testing.T) {
+	pq := NewPriority()
+	calls := 0
+	priorities := map[string]int64{"a": 3, "b": 1, "c": 2}
+	items := make(map[string]*Item)
+	for _, v := range []string{"a", "b", "c"} {
+		v := v
+		items[v] = &Item{Value: v, Priority: func() int64 {
+			calls++
+			return priorities[v]
+		}}
+		pq.Push(items[v])
+	}
+	if calls != 3 {
+		t.Fatalf("expected Priority to be evaluated once per Push, got %d calls", calls)
+	}
+
+	// 优先级变化后需要调用Fix才会重新排序
+	priorities["a"] = 0
+	if item := pq.Peek().(*Item); item.Value != "b" {
+		t.Fatalf("expected b at the head before Fix, got %v", item.Value)
+	}
+	pq.Fix(items["a"])
+	for _, expected := range []string{"a", "b", "c"} {
+		if item := pq.Pop().(*Item); item.Value != expected {
+			t.Fatalf("expected %s to be popped, got %v", expected, item.Value)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("expected Priority to be evaluated again only by Fix, got %d calls", calls)
+	}
+}
+
+// job 记录自己在堆中位置的元素
+type job struct{ priority, index int }
+
+func (j *job) Index() int     { return j.index }
+func (j *job) SetIndex(i int) { j.index = i }
+
+func TestPriorityQueueOf_Fix(t *testing.T) {
+	jobs := []*job{{priority: 3}, {priority: 1}, {priority: 2}}
+	pq := NewPriorityOf(func(a, b *job) bool { return a.priority < b.priority })
+	pq.Init(jobs)
+	jobs[0].priority = 0
+	if !pq.Fix(jobs[0]) {
+		t.Fatal("expected Fix to find the job")
+	}
+	if v, _ := pq.Pop(); v != jobs[0] {
+		t.Errorf("expected the fixed job at the head, got %v", v)
+	}
+	if pq.Fix(jobs[0]) {
+		t.Error("expected Fix not to find a popped job")
+	}
+}
+
+func TestPriorityQueue_Remove(t *testing.T) {
+	pq := NewPriority()
+	items := make([]*Item, 6)
+	for i := range items {
+		priority := int64(i)
+		items[i] = &Item{Value: i, Priority: func() int64 { return priority }}
+		pq.Push(items[i])
+	}
+	if !pq.Remove(items[0]) || pq.Remove(items[0]) {
+		t.Fatal("expected only the first Remove of an item to succeed")
+	}
+	if pq.Contains(items[0]) || !pq.Contains(items[3]) {
+		t.Fatal("expected Contains to reflect the removal")
+	}
+	// 删除偶数
+	if n := pq.RemoveIf(func(x interface{}) bool { return x.(*Item).Value.(int)%2 == 0 }); n != 2 {
+		t.Fatalf("expected 2 items to be removed, got %d", n)
+	}
+	if items[2].Index() != -1 || pq.Contains(items[4]) {
+		t.Error("expected removed items to be detached")
+	}
+	for _, expected := range []int{1, 3, 5} {
+		if item := pq.Pop().(*Item); item.Value != expected {
+			t.Fatalf("expected %d to be popped, got %v", expected, item.Value)
+		}
+	}
+}
+
+func TestPriorityQueueOf_Remove(t *testing.T) {
+	jobs := make([]*job, 6)
+	for i := range jobs {
+		jobs[i] = &job{priority: i}
+	}
+	pq := NewPriorityOf(func(a, b *job) bool { return a.priority < b.priority })
+	pq.Init(jobs[1:])
+	if pq.Contains(jobs[0]) || pq.Remove(jobs[0]) {
+		t.Fatal("expected a job that was never queued not to be found")
+	}
+	if !pq.Remove(jobs[1]) || pq.Contains(jobs[1]) || !pq.Contains(jobs[2]) || jobs[1].Index() != -1 {
+		t.Fatal("expected 1 to be removed")
+	}
+	if n := pq.RemoveIf(func(j *job) bool { return j.priority > 3 }); n != 2 || pq.Len() != 2 {
+		t.Fatalf("expected 2 jobs to be removed leaving 2, got %d leaving %d", n, pq.Len())
+	}
+	if v, _ := pq.Pop(); v != jobs[2] {
+		t.Errorf("expected 2 at the head, got %d", v.priority)
+	}
+	pq.Clear()
+	if jobs[3].Index() != -1 || pq.Contains(jobs[3]) {
+		t.Error("expected cleared jobs to be detached")
+	}
+}
+
+// 不可比较的值不会引起panic；没有实现Indexed的值无法查找
+func TestPriorityQueueOf_RemoveUnindexed(t *testing.T) {
+	pq := NewPriorityOf(func(a, b interface{}) bool { return false })
+	pq.Push([]int{1})
+	pq.Push(&job{})
+	if pq.Contains(&job{}) {
+		t.Fatal("expected a different job not to be found")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected Remove of a value not implementing Indexed to panic")
+		}
+	}()
+	pq.Remove([]int{1})
+}
@@ -0,0 +1,346 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+)
+
+// ErrLeaseExpired is returned when a Lease is settled after its visibility
+// timeout expired, or settled twice.
+var ErrLeaseExpired = errors.New("queue: lease expired or already settled")
+
+// reliableConfig holds the settings given to NewReliable.
+type reliableConfig struct {
+	visibility    time.Duration
+	maxDeliveries int
+	queueOpts     []Option
+}
+
+// ReliableOption configures a ReliableQueue.
+type ReliableOption func(*reliableConfig)
+
+// WithVisibilityTimeout sets how long a received element stays invisible to
+// other consumers before it is delivered again, 30 seconds by default.
+func WithVisibilityTimeout(d time.Duration) ReliableOption {
+	if d <= 0 {
+		panic("queue: visibility timeout must be positive")
+	}
+	return func(cfg *reliableConfig) {
+		cfg.visibility = d
+	}
+}
+
+// WithMaxDeliveries sets how many times an element is delivered before it
+// is moved to the dead-letter queue instead. Elements are delivered until
+// acknowledged by default.
+func WithMaxDeliveries(n int) ReliableOption {
+	if n <= 0 {
+		panic("queue: max deliveries must be positive")
+	}
+	return func(cfg *reliableConfig) {
+		cfg.maxDeliveries = n
+	}
+}
+
+// WithDelayOptions sets the options of the underlying DelayQueueOf, e.g.
+// WithClock or WithCapacity. The capacity only applies to offers.
+func WithDelayOptions(opts ...Option) ReliableOption {
+	return func(cfg *reliableConfig) {
+		cfg.queueOpts = append(cfg.queueOpts, opts...)
+	}
+}
+
+// ReliableQueue is a delay queue whose consumers acknowledge the elements
+// they process. Receive hands out an element under a Lease; unless the lease
+// is acknowledged within the visibility timeout, the element is delivered
+// again. Elements delivered too many times are moved to the dead-letter
+// queue.
+type ReliableQueue[T Delayed] struct {
+	q             *DelayQueueOf[*envelope[T]]
+	deadLetters   *DelayQueueOf[T]
+	clock         clock.Clock
+	visibility    time.Duration
+	maxDeliveries int
+
+	mu       sync.Mutex
+	waiting  int // 等待投递的元素数，不包括可见性超时；元素在计数之前就可能被投递，短暂为负
+	inFlight int
+}
+
+// envelope 队列中的元素。lease不为空时，envelope是该租约的可见性超时，
+// 租约结算或延长后失效，留在队列中直到弹出时丢弃
+type envelope[T Delayed] struct {
+	value      T
+	deliveries int
+	due        time.Time // 不为零时代替元素自身的延时
+	lease      *Lease[T]
+	clock      clock.Clock
+}
+
+func (e *envelope[T]) GetDelay() time.Duration {
+	if e.due.IsZero() {
+		return e.value.GetDelay()
+	}
+	return e.due.Sub(e.clock.Now())
+}
+
+// NewReliable returns an empty ReliableQueue configured by the given options.
+func NewReliable[T Delayed](opts ...ReliableOption) *ReliableQueue[T] {
+	cfg := reliableConfig{visibility: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	delayCfg := delayConfig{clock: clock.System}
+	for _, opt := range cfg.queueOpts {
+		opt(&delayCfg)
+	}
+	return &ReliableQueue[T]{
+		q:             NewDelayOf[*envelope[T]](cfg.queueOpts...),
+		deadLetters:   NewDelayOf[T](WithClock(delayCfg.clock)),
+		clock:         delayCfg.clock,
+		visibility:    cfg.visibility,
+		maxDeliveries: cfg.maxDeliveries,
+	}
+}
+
+// Offer adds e to the queue, waiting for room until ctx is done, see
+// DelayQueueOf.Offer.
+func (rq *ReliableQueue[T]) Offer(ctx context.Context, e T) error {
+	err := rq.q.Offer(ctx, &envelope[T]{value: e, clock: rq.clock})
+	if err == nil {
+		rq.offered()
+	}
+	return err
+}
+
+// TryOffer adds e to the queue without waiting, see DelayQueueOf.TryOffer.
+func (rq *ReliableQueue[T]) TryOffer(e T) error {
+	err := rq.q.TryOffer(&envelope[T]{value: e, clock: rq.clock})
+	if err == nil {
+		rq.offered()
+	}
+	return err
+}
+
+// offered counts an element added by an offer. A consumer may have taken it
+// already, so waiting can be briefly negative.
+func (rq *ReliableQueue[T]) offered() {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	rq.waiting++
+}
+
+// Receive waits for an element to expire, or for the visibility timeout of an
+// unacknowledged one, and delivers it under a new Lease. It returns false if
+// ctx is done or the queue is released first.
+func (rq *ReliableQueue[T]) Receive(ctx context.Context) (*Lease[T], bool) {
+	for {
+		env, ok := rq.q.Pop(ctx)
+		if !ok {
+			return nil, false
+		}
+		if lease := rq.deliver(env); lease != nil {
+			return lease, true
+		}
+	}
+}
+
+// TryReceive delivers an expired element under a new Lease without waiting.
+func (rq *ReliableQueue[T]) TryReceive() (*Lease[T], bool) {
+	for {
+		env, ok := rq.q.Poll()
+		if !ok {
+			return nil, false
+		}
+		if lease := rq.deliver(env); lease != nil {
+			return lease, true
+		}
+	}
+}
+
+// deliver leases out a popped envelope. It returns nil if the envelope is
+// the stale visibility timeout of a settled lease, or if the element went to
+// the dead-letter queue.
+func (rq *ReliableQueue[T]) deliver(env *envelope[T]) *Lease[T] {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if env.lease != nil {
+		if env.lease.settled || env.lease.env != env {
+			return nil
+		}
+		// 租约超时未确认，重新投递
+		env.lease.settled = true
+		rq.inFlight--
+	} else {
+		rq.waiting--
+	}
+	if rq.maxDeliveries > 0 && env.deliveries >= rq.maxDeliveries {
+		rq.deadLetters.TryOffer(env.value)
+		return nil
+	}
+	lease := &Lease[T]{
+		q:          rq,
+		value:      env.value,
+		deliveries: env.deliveries + 1,
+	}
+	rq.inFlight++
+	rq.schedule(lease, rq.visibility)
+	return lease
+}
+
+// schedule sets the visibility timeout of lease to expire after d. It must
+// be called with mu held.
+func (rq *ReliableQueue[T]) schedule(lease *Lease[T], d time.Duration) {
+	lease.deadline = rq.clock.Now().Add(d)
+	lease.env = &envelope[T]{
+		value:      lease.value,
+		deliveries: lease.deliveries,
+		due:        lease.deadline,
+		lease:      lease,
+		clock:      rq.clock,
+	}
+	rq.requeue(lease.env)
+}
+
+// requeue adds env to the queue regardless of its capacity, unless the queue
+// has been released, and reports whether it was added.
+func (rq *ReliableQueue[T]) requeue(env *envelope[T]) bool {
+	rq.q.mu.Lock()
+	defer rq.q.mu.Unlock()
+	if rq.q.released {
+		return false
+	}
+	rq.q.push(env)
+	return true
+}
+
+// Len returns the number of elements waiting to be delivered, not counting
+// the ones in flight.
+func (rq *ReliableQueue[T]) Len() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if rq.waiting < 0 {
+		return 0
+	}
+	return rq.waiting
+}
+
+// InFlight returns the number of elements delivered and not yet settled.
+func (rq *ReliableQueue[T]) InFlight() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.inFlight
+}
+
+// DeadLetters returns the queue of the elements that were delivered the
+// maximum number of times without being acknowledged.
+func (rq *ReliableQueue[T]) DeadLetters() *DelayQueueOf[T] {
+	return rq.deadLetters
+}
+
+// Release closes the queue and returns the elements that were waiting or in
+// flight. Leases can no longer be settled.
+func (rq *ReliableQueue[T]) Release() []T {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	var pending []T
+	for _, env := range rq.q.Release() {
+		if env.lease == nil {
+			pending = append(pending, env.value)
+		} else if !env.lease.settled && env.lease.env == env {
+			env.lease.settled = true
+			pending = append(pending, env.value)
+		}
+	}
+	rq.waiting, rq.inFlight = 0, 0
+	return pending
+}
+
+// Lease is the delivery of an element by ReliableQueue.Receive. Exactly one
+// of Ack or Nack should be called before the deadline.
+type Lease[T Delayed] struct {
+	q          *ReliableQueue[T]
+	value      T
+	deliveries int
+	env        *envelope[T] // 当前的可见性超时
+	deadline   time.Time
+	settled    bool
+}
+
+// Value returns the delivered element.
+func (l *Lease[T]) Value() T {
+	return l.value
+}
+
+// Deliveries returns how many times the element has been delivered,
+// including this delivery.
+func (l *Lease[T]) Deliveries() int {
+	return l.deliveries
+}
+
+// Deadline returns when the element is delivered again unless the lease is
+// settled.
+func (l *Lease[T]) Deadline() time.Time {
+	l.q.mu.Lock()
+	defer l.q.mu.Unlock()
+	return l.deadline
+}
+
+// Ack acknowledges the element, which is removed for good.
+func (l *Lease[T]) Ack() error {
+	rq := l.q
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if l.settled {
+		return ErrLeaseExpired
+	}
+	// 可见性超时随之失效，弹出时丢弃
+	l.settled = true
+	rq.inFlight--
+	return nil
+}
+
+// Nack gives the element back to be delivered again after delay, or moves
+// it to the dead-letter queue if it was delivered the maximum number of
+// times.
+func (l *Lease[T]) Nack(delay time.Duration) error {
+	rq := l.q
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if l.settled {
+		return ErrLeaseExpired
+	}
+	l.settled = true
+	rq.inFlight--
+	if rq.maxDeliveries > 0 && l.deliveries >= rq.maxDeliveries {
+		rq.deadLetters.TryOffer(l.value)
+		return nil
+	}
+	if rq.requeue(&envelope[T]{
+		value:      l.value,
+		deliveries: l.deliveries,
+		due:        rq.clock.Now().Add(delay),
+		clock:      rq.clock,
+	}) {
+		rq.waiting++
+	}
+	return nil
+}
+
+// Extend postpones the deadline of the lease to d from now, for consumers
+// that need longer than the visibility timeout.
+func (l *Lease[T]) Extend(d time.Duration) error {
+	rq := l.q
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if l.settled {
+		return ErrLeaseExpired
+	}
+	// 之前的可见性超时失效，弹出时丢弃
+	rq.schedule(l, d)
+	return nil
+}
@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+)
+
+func TestReliableQueue_Visibility(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rq := NewReliable[*fakeDelayed](WithVisibilityTimeout(time.Minute), WithDelayOptions(WithClock(clk)))
+	rq.TryOffer(&fakeDelayed{name: "a", exp: clk.Now(), clock: clk})
+	rq.TryOffer(&fakeDelayed{name: "b", exp: clk.Now(), clock: clk})
+
+	a, ok := rq.TryReceive()
+	if !ok || a.Value().name != "a" || a.Deliveries() != 1 {
+		t.Fatalf("expected first delivery of a, got %v", a)
+	}
+	b, _ := rq.TryReceive()
+	if rq.Len() != 0 || rq.InFlight() != 2 {
+		t.Fatalf("expected 0 waiting and 2 in flight, got %d and %d", rq.Len(), rq.InFlight())
+	}
+	if err := b.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	// b的可见性超时失效但留在队列中，不计入Len
+	if rq.Len() != 0 || rq.InFlight() != 1 {
+		t.Fatalf("expected 0 waiting and 1 in flight, got %d and %d", rq.Len(), rq.InFlight())
+	}
+	if _, ok := rq.TryReceive(); ok {
+		t.Fatal("expected nothing to be visible before the timeout")
+	}
+
+	// a没有确认，超时后重新投递；b的超时失效，不再投递
+	clk.Advance(time.Minute)
+	redelivered, ok := rq.TryReceive()
+	if !ok || redelivered.Value() != a.Value() || redelivered.Deliveries() != 2 {
+		t.Fatalf("expected second delivery of a, got %v", redelivered)
+	}
+	if _, ok := rq.TryReceive(); ok {
+		t.Fatal("expected the acknowledged element not to be delivered again")
+	}
+	if err := a.Ack(); err != ErrLeaseExpired {
+		t.Fatalf("expected the expired lease to fail with ErrLeaseExpired, got %v", err)
+	}
+
+	if err := redelivered.Extend(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if rq.Len() != 0 || rq.InFlight() != 1 {
+		t.Fatalf("expected 0 waiting and 1 in flight, got %d and %d", rq.Len(), rq.InFlight())
+	}
+	clk.Advance(time.Minute)
+	if _, ok := rq.TryReceive(); ok {
+		t.Fatal("expected the extended lease to stay invisible")
+	}
+	if err := redelivered.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if rq.Len() != 0 || rq.InFlight() != 0 {
+		t.Fatalf("expected an empty queue, got %d waiting and %d in flight", rq.Len(), rq.InFlight())
+	}
+	// 失效的超时到期后被丢弃
+	clk.Advance(time.Hour)
+	if _, ok := rq.TryReceive(); ok || rq.q.Len() != 0 {
+		t.Fatalf("expected the stale timeouts to be discarded, %d left", rq.q.Len())
+	}
+
+	// Nack后只有重新投递的元素计入Len，失效的超时被丢弃
+	rq.TryOffer(&fakeDelayed{name: "c", exp: clk.Now(), clock: clk})
+	c, _ := rq.TryReceive()
+	if err := c.Nack(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if rq.Len() != 1 || rq.InFlight() != 0 {
+		t.Fatalf("expected the nacked element to be waiting, got %d waiting and %d in flight", rq.Len(), rq.InFlight())
+	}
+	clk.Advance(time.Minute)
+	if again, ok := rq.TryReceive(); !ok || again.Value().name != "c" || again.Deliveries() != 2 {
+		t.Fatalf("expected second delivery of c, got %v", again)
+	}
+	if _, ok := rq.TryReceive(); ok || rq.Len() != 0 {
+		t.Fatalf("expected the stale timeout of c to be discarded, got %d waiting", rq.Len())
+	}
+}
+
+func TestReliableQueue_DeadLetter(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rq := NewReliable[*fakeDelayed](WithMaxDeliveries(2), WithDelayOptions(WithClock(clk)))
+	poison := &fakeDelayed{name: "poison", exp: clk.Now(), clock: clk}
+	rq.TryOffer(poison)
+
+	lease, _ := rq.TryReceive()
+	if err := lease.Nack(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rq.TryReceive(); ok {
+		t.Fatal("expected the nacked element to be delayed")
+	}
+
+	done := make(chan *Lease[*fakeDelayed])
+	go func() {
+		lease, _ := rq.Receive(context.Background())
+		done <- lease
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	lease = <-done
+	if lease.Deliveries() != 2 {
+		t.Fatalf("expected second delivery, got %d", lease.Deliveries())
+	}
+
+	// 第二次投递超时未确认，进入死信队列
+	clk.Advance(30 * time.Second)
+	if _, ok := rq.TryReceive(); ok {
+		t.Fatal("expected the poison element not to be delivered a third time")
+	}
+	if d, ok := rq.DeadLetters().Poll(); !ok || d != poison {
+		t.Fatalf("expected the poison element in the dead-letter queue, got %v", d)
+	}
+	if rq.Len() != 0 || rq.InFlight() != 0 {
+		t.Fatalf("expected an empty queue, got %d waiting and %d in flight", rq.Len(), rq.InFlight())
+	}
+}
+
+func TestReliableQueue_Release(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rq := NewReliable[*fakeDelayed](WithDelayOptions(WithClock(clk)))
+	rq.TryOffer(&fakeDelayed{name: "a", exp: clk.Now(), clock: clk})
+	rq.TryOffer(&fakeDelayed{name: "b", exp: clk.Now().Add(time.Hour), clock: clk})
+	lease, _ := rq.TryReceive()
+
+	if pending := rq.Release(); len(pending) != 2 {
+		t.Fatalf("expected the waiting and in-flight elements, got %d", len(pending))
+	}
+	if err := lease.Nack(0); err != ErrLeaseExpired {
+		t.Fatalf("expected released leases to fail with ErrLeaseExpired, got %v", err)
+	}
+	if _, ok := rq.Receive(context.Background()); ok {
+		t.Fatal("expected Receive to fail once released")
+	}
+}
@@ -0,0 +1,79 @@
+package timer
+
+import (
+	"context"
+	"time"
+)
+
+// ContextTask is a task whose Run observes cancellation. The context given to
+// Run is cancelled when the task is cancelled through its Handle or the timer
+// is shut down, and carries the TaskInfo of the run.
+type ContextTask interface {
+	GetID() int64
+	// GetDelay returns the delay of the task in the TimeUnit of the timer.
+	GetDelay() int64
+	Run(ctx context.Context)
+}
+
+// TaskInfo describes the run of a ContextTask.
+type TaskInfo struct {
+	// ID is the ID of the task.
+	ID int64
+	// Scheduled is the time the run was scheduled for, by the clock of the
+	// timer.
+	Scheduled time.Time
+}
+
+type taskInfoKey struct{}
+
+// TaskInfoFrom returns the TaskInfo carried by the context of a ContextTask.
+func TaskInfoFrom(ctx context.Context) (TaskInfo, bool) {
+	info, ok := ctx.Value(taskInfoKey{}).(TaskInfo)
+	return info, ok
+}
+
+// ScheduleContext adds task to the timer like Schedule, and returns a Handle
+// whose Cancel also cancels the context of a running task.
+func (t *SystemTimer) ScheduleContext(task ContextTask) *Handle {
+	h := &Handle{timer: t, id: task.GetID(), run: task.Run, done: make(chan struct{})}
+	h.schedule(t.clock.Now().Add(t.unit.ToDuration(task.GetDelay())))
+	return h
+}
+
+// NewContextTask returns a ContextTask that runs r after delay, in the
+// TimeUnit of the timer, like NewSimpleTask.
+func NewContextTask(id int64, delay int64, r func(ctx context.Context)) ContextTask {
+	return &contextTask{id: id, delay: delay, run: r}
+}
+
+type contextTask struct {
+	id    int64
+	delay int64
+	run   func(ctx context.Context)
+}
+
+func (t *contextTask) GetID() int64 {
+	return t.id
+}
+
+func (t *contextTask) GetDelay() int64 {
+	return t.delay
+}
+
+func (t *contextTask) Run(ctx context.Context) {
+	t.run(ctx)
+}
+
+// WithoutContext adapts a Task to the ContextTask interface. Its Run ignores
+// the context.
+func WithoutContext(task Task) ContextTask {
+	return ignoreContext{task}
+}
+
+type ignoreContext struct {
+	Task
+}
+
+func (t ignoreContext) Run(context.Context) {
+	t.Task.Run()
+}
@@ -0,0 +1,85 @@
+package timer
+
+import (
+	"github.com/GuoCeng/time-wheel/logging"
+	"github.com/panjf2000/ants/v2"
+)
+
+// Executor runs the tasks whose expiration has been reached.
+type Executor interface {
+	// Execute runs f, either on the calling goroutine or asynchronously.
+	Execute(f func())
+}
+
+// GoExecutor runs every task in a goroutine of its own. It is the default
+// Executor of SystemTimer.
+type GoExecutor struct{}
+
+func (GoExecutor) Execute(f func()) {
+	go f()
+}
+
+// SyncExecutor runs tasks on the goroutine that advances the clock, one after
+// the other. It is mainly useful in tests, where it makes task execution
+// deterministic.
+type SyncExecutor struct{}
+
+func (SyncExecutor) Execute(f func()) {
+	f()
+}
+
+// PoolExecutor runs tasks on a bounded goroutine pool, so that a bucket
+// holding many expired tasks does not start a goroutine for each of them.
+type PoolExecutor struct {
+	pool *ants.Pool
+
+	// OnReject is called with the tasks the pool refuses, because it is
+	// overloaded or has been released. When nil, refused tasks are logged
+	// with logging.DefaultLogger and dropped, so that the reaper is never
+	// held back by running them itself. It must be set before the executor
+	// is used.
+	OnReject RejectHandler
+}
+
+// RejectHandler handles a task f refused by a PoolExecutor with err.
+type RejectHandler func(f func(), err error)
+
+// CallerRuns is a RejectHandler that runs refused tasks on the goroutine
+// calling Execute, usually the reaper. No task is dropped, at the cost of
+// stalling the timing wheel while the task runs.
+func CallerRuns(f func(), err error) {
+	f()
+}
+
+// NewPoolExecutor returns a PoolExecutor running at most size tasks at once.
+// Unless ants.WithNonblocking is given, Execute blocks while every worker is
+// busy, which in turn holds back the advance of the clock.
+func NewPoolExecutor(size int, options ...ants.Option) (*PoolExecutor, error) {
+	pool, err := ants.NewPool(size, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolExecutor{pool: pool}, nil
+}
+
+// Execute submits f to the pool. If the pool refuses it, f is handed to
+// OnReject.
+func (e *PoolExecutor) Execute(f func()) {
+	if err := e.pool.Submit(f); err != nil {
+		if e.OnReject != nil {
+			e.OnReject(f, err)
+			return
+		}
+		logging.DefaultLogger.Error(err, "task rejected by the pool and dropped")
+	}
+}
+
+// Running returns the number of tasks currently running.
+func (e *PoolExecutor) Running() int {
+	return e.pool.Running()
+}
+
+// Release closes the pool. Tasks executed afterwards are rejected.
+func (e *PoolExecutor) Release() {
+	e.pool.Release()
+}
@@ -0,0 +1,185 @@
+package timer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Handle controls a function scheduled on a SystemTimer by AfterFunc,
+// Schedule or one of the periodic variants, like the time.Timer returned by
+// time.AfterFunc.
+type Handle struct {
+	timer  *SystemTimer
+	id     int64
+	run    func(ctx context.Context)
+	repeat func(prev time.Time) (time.Time, bool) //周期任务返回下次执行的时间，一次性任务为nil
+
+	mu       sync.Mutex
+	task     *SimpleTask // 当前在时间轮中的任务，执行或取消后为nil
+	running  bool
+	stopped  bool // 周期任务在执行期间被取消，不再调度
+	deadline time.Time
+	done     chan struct{}
+	ctx      context.Context // 执行时传给任务的上下文，Cancel或不再执行时取消
+	cancel   context.CancelFunc
+}
+
+// AfterFunc runs f once d has elapsed, on the Executor of the timer. If the
+// timer has been shut down, f never runs and Done is closed right away.
+func (t *SystemTimer) AfterFunc(d time.Duration, f func()) *Handle {
+	h := &Handle{timer: t, run: func(context.Context) { f() }, done: make(chan struct{})}
+	h.schedule(t.clock.Now().Add(d))
+	return h
+}
+
+// Schedule adds task to the timer like Add, and returns a Handle to cancel
+// or reschedule it. The task is run through the handle, so it does not need
+// to manage its own TaskEntry.
+func (t *SystemTimer) Schedule(task Task) *Handle {
+	return t.ScheduleContext(WithoutContext(task))
+}
+
+// delayOf 将d换算为定时器的单位，向上取整，任务不会早于d执行
+func (t *SystemTimer) delayOf(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	delay := t.unit.ConvertDuration(d)
+	if t.unit.ToDuration(delay) < d {
+		delay++
+	}
+	return delay
+}
+
+// schedule 按deadline将一个新的任务加入时间轮
+func (h *Handle) schedule(deadline time.Time) {
+	h.mu.Lock()
+	task := h.newTask(deadline)
+	h.mu.Unlock()
+	h.add(task)
+}
+
+// newTask 创建在deadline执行的任务并记为当前任务，调用方需持有锁
+func (h *Handle) newTask(deadline time.Time) *SimpleTask {
+	var task *SimpleTask
+	delay := h.timer.delayOf(deadline.Sub(h.timer.clock.Now()))
+	task = NewSimpleTask(h.id, delay, func() { h.fire(task) })
+	if h.ctx == nil || h.ctx.Err() != nil {
+		h.ctx, h.cancel = context.WithCancel(h.timer.ctx)
+	}
+	h.task = task
+	h.deadline = deadline
+	return task
+}
+
+// add 调用Add时不能持有锁，已到期的任务可能在Add中同步执行
+func (h *Handle) add(task *SimpleTask) {
+	if h.timer.Add(task) != nil {
+		h.settle(task)
+	}
+}
+
+func (h *Handle) fire(task *SimpleTask) {
+	h.mu.Lock()
+	if h.task != task {
+		// 执行前已被取消或重置
+		h.mu.Unlock()
+		return
+	}
+	h.task = nil
+	h.running = true
+	done := h.done
+	ctx := context.WithValue(h.ctx, taskInfoKey{}, TaskInfo{ID: h.id, Scheduled: h.deadline})
+	h.mu.Unlock()
+
+	h.run(ctx)
+
+	h.mu.Lock()
+	h.running = false
+	// 执行期间被Reset时，已经调度了新的任务
+	if h.repeat != nil && h.task == nil && h.done == done && !h.stopped {
+		if next, ok := h.repeat(h.deadline); ok {
+			task := h.newTask(next)
+			h.mu.Unlock()
+			h.add(task)
+			return
+		}
+	}
+	if h.task == nil {
+		h.cancel()
+	}
+	h.mu.Unlock()
+	close(done)
+}
+
+// settle 任务不再执行时关闭done
+func (h *Handle) settle(task *SimpleTask) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.task != task {
+		return false
+	}
+	h.task = nil
+	h.cancel()
+	close(h.done)
+	return true
+}
+
+// Cancel prevents the function from running. It returns true if the call
+// stops it, false if it has already run, is running or has been cancelled.
+// Done is closed once Cancel returns true. A periodic function is stopped
+// even while it runs: Cancel returns true and Done is closed after the run.
+// In any case, the context of a running function is cancelled.
+func (h *Handle) Cancel() bool {
+	h.mu.Lock()
+	task := h.task
+	if task == nil {
+		if h.cancel != nil {
+			h.cancel()
+		}
+		stopped := h.running && h.repeat != nil && !h.stopped
+		h.stopped = h.stopped || stopped
+		h.mu.Unlock()
+		return stopped
+	}
+	h.mu.Unlock()
+	task.Cancel()
+	return h.settle(task)
+}
+
+// Reset reschedules the function to run once d has elapsed, and reports
+// whether it was pending. As with time.Timer, the function runs again if it
+// had already run; Done then returns a new channel for the new run. A
+// periodic function resumes its period from the new run.
+func (h *Handle) Reset(d time.Duration) bool {
+	h.mu.Lock()
+	old := h.task
+	if old == nil {
+		h.done = make(chan struct{})
+	}
+	h.stopped = false
+	task := h.newTask(h.timer.clock.Now().Add(d))
+	h.mu.Unlock()
+	if old != nil {
+		old.Cancel()
+	}
+	h.add(task)
+	return old != nil
+}
+
+// Deadline returns the time at which the function is, or was last,
+// scheduled to run. For a periodic function it is the next run.
+func (h *Handle) Deadline() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.deadline
+}
+
+// Done returns a channel that is closed once the function has run or been
+// cancelled. For a periodic function it is closed after the last run.
+func (h *Handle) Done() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.done
+}
@@ -0,0 +1,79 @@
+package timer
+
+import (
+	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+	"github.com/GuoCeng/time-wheel/logging"
+	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
+)
+
+// Option configures a SystemTimer.
+type Option func(*SystemTimer)
+
+// WithTickMs sets the duration of one tick of the innermost wheel, in
+// milliseconds. It is the precision of the timer: tasks run at most one tick
+// before their expiration. The default is 1ms.
+func WithTickMs(tickMs int64) Option {
+	if tickMs <= 0 {
+		panic("timer: non-positive tick for WithTickMs")
+	}
+	return WithTick(time.Duration(tickMs) * time.Millisecond)
+}
+
+// WithTick sets the duration of one tick of the innermost wheel, like
+// WithTickMs, e.g. 100µs with WithTimeUnit(unit.MICROSECONDS). It is
+// truncated to the time unit of the timer and must be at least one unit.
+func WithTick(d time.Duration) Option {
+	if d <= 0 {
+		panic("timer: non-positive tick for WithTick")
+	}
+	return func(t *SystemTimer) {
+		t.tickSize = d
+	}
+}
+
+// WithTimeUnit sets the unit of the timer: the delays returned by
+// Task.GetDelay and the internal clock of the wheels are expressed in u.
+// Finer units, with a matching WithTick, allow sub-millisecond precision.
+// The default is unit.MILLISECONDS.
+func WithTimeUnit(u *unit.TimeUnit) Option {
+	return func(t *SystemTimer) {
+		t.unit = u
+	}
+}
+
+// WithWheelSize sets the number of buckets of every wheel. The innermost
+// wheel spans tick*wheelSize, each overflow wheel wheelSize
+// times its inner wheel. The default is 20.
+func WithWheelSize(wheelSize int) Option {
+	if wheelSize <= 0 {
+		panic("timer: non-positive size for WithWheelSize")
+	}
+	return func(t *SystemTimer) {
+		t.wheelSize = wheelSize
+	}
+}
+
+// WithClock sets the time source of the timer. The default is clock.System.
+func WithClock(c clock.Clock) Option {
+	return func(t *SystemTimer) {
+		t.clock = c
+	}
+}
+
+// WithExecutor sets the Executor that runs expired tasks. The default,
+// GoExecutor, starts a goroutine per task.
+func WithExecutor(e Executor) Option {
+	return func(t *SystemTimer) {
+		t.executor = e
+	}
+}
+
+// WithLogger sets the logger of the timer, which logs the advances of the
+// clock at Info level. The default is logging.DefaultLogger.
+func WithLogger(l logging.Logger) Option {
+	return func(t *SystemTimer) {
+		t.logger = l
+	}
+}
@@ -0,0 +1,85 @@
+package timer
+
+import (
+	"context"
+	"time"
+)
+
+// PeriodicOption limits the runs of ScheduleAtFixedRate and
+// ScheduleWithFixedDelay.
+type PeriodicOption func(*periodicConfig)
+
+type periodicConfig struct {
+	maxRuns int
+	end     time.Time
+}
+
+// WithMaxRuns stops the periodic function after n runs.
+func WithMaxRuns(n int) PeriodicOption {
+	if n <= 0 {
+		panic("timer: non-positive count for WithMaxRuns")
+	}
+	return func(cfg *periodicConfig) {
+		cfg.maxRuns = n
+	}
+}
+
+// WithEndTime stops the periodic function once its next run would be after
+// end, measured by the clock of the timer.
+func WithEndTime(end time.Time) PeriodicOption {
+	return func(cfg *periodicConfig) {
+		cfg.end = end
+	}
+}
+
+// ScheduleAtFixedRate runs f after initialDelay, then every period, like
+// ScheduledExecutorService.scheduleAtFixedRate in Java. The runs are planned
+// from the first one rather than from the end of the previous run, so they
+// do not drift; a run that falls behind is followed right away by the next
+// one. The returned Handle stops the runs.
+func (t *SystemTimer) ScheduleAtFixedRate(initialDelay, period time.Duration, f func(), opts ...PeriodicOption) *Handle {
+	if period <= 0 {
+		panic("timer: non-positive period for ScheduleAtFixedRate")
+	}
+	return t.schedulePeriodic(initialDelay, f, opts, func(prev time.Time) time.Time {
+		return prev.Add(period)
+	})
+}
+
+// ScheduleWithFixedDelay runs f after initialDelay, then again delay after
+// the end of every run, like ScheduledExecutorService.scheduleWithFixedDelay
+// in Java. The returned Handle stops the runs.
+func (t *SystemTimer) ScheduleWithFixedDelay(initialDelay, delay time.Duration, f func(), opts ...PeriodicOption) *Handle {
+	if delay <= 0 {
+		panic("timer: non-positive delay for ScheduleWithFixedDelay")
+	}
+	return t.schedulePeriodic(initialDelay, f, opts, func(time.Time) time.Time {
+		return t.clock.Now().Add(delay)
+	})
+}
+
+// schedulePeriodic 调度周期任务，next根据上次计划执行的时间计算下次执行的时间
+func (t *SystemTimer) schedulePeriodic(initialDelay time.Duration, f func(), opts []PeriodicOption, next func(prev time.Time) time.Time) *Handle {
+	var cfg periodicConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	runs := 0
+	h := &Handle{timer: t, run: func(context.Context) { f() }, done: make(chan struct{})}
+	h.repeat = func(prev time.Time) (time.Time, bool) {
+		runs++
+		if cfg.maxRuns > 0 && runs >= cfg.maxRuns {
+			return time.Time{}, false
+		}
+		at := next(prev)
+		return at, cfg.end.IsZero() || !at.After(cfg.end)
+	}
+	first := t.clock.Now().Add(initialDelay)
+	if !cfg.end.IsZero() && first.After(cfg.end) {
+		h.deadline = first
+		close(h.done)
+		return h
+	}
+	h.schedule(first)
+	return h
+}
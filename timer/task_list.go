@@ -6,11 +6,14 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/GuoCeng/time-wheel/clock"
 	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
 )
 
 type Task interface {
 	GetID() int64
+	// GetDelay returns the delay of the task in the TimeUnit of the timer,
+	// milliseconds by default.
 	GetDelay() int64
 	Cancel()
 	SetTaskEntry(entry *TaskEntry)
@@ -21,7 +24,7 @@ type Task interface {
 type SimpleTask struct {
 	mu        sync.RWMutex
 	id        int64
-	delayMs   int64
+	delay     int64
 	taskEntry *TaskEntry
 	run       func()
 }
@@ -31,7 +34,7 @@ func (t *SimpleTask) GetID() int64 {
 }
 
 func (t *SimpleTask) GetDelay() int64 {
-	return t.delayMs
+	return t.delay
 }
 
 func (t *SimpleTask) Cancel() {
@@ -62,11 +65,13 @@ func (t *SimpleTask) Run() {
 	t.run()
 }
 
-func NewSimpleTask(id int64, delayMs int64, r func()) *SimpleTask {
+// NewSimpleTask returns a task that runs r after delay, in the TimeUnit of
+// the timer it is added to.
+func NewSimpleTask(id int64, delay int64, r func()) *SimpleTask {
 	return &SimpleTask{
-		id:      id,
-		delayMs: delayMs,
-		run:     r,
+		id:    id,
+		delay: delay,
+		run:   r,
 	}
 }
 
@@ -79,11 +84,14 @@ func NewTaskEntry(task Task, exp int64) *TaskEntry {
 	return taskEntry
 }
 
+// TaskEntry 任务在桶中的节点，桶是以TaskList为哨兵的双向循环链表
 type TaskEntry struct {
 	mu   sync.Mutex
-	exp  int64 //毫秒数
+	exp  int64 //到期时间，单位为定时器的TimeUnit
 	task Task
 	list *TaskList
+	next *TaskEntry
+	prev *TaskEntry
 }
 
 func (t *TaskEntry) clearTask() {
@@ -92,18 +100,18 @@ func (t *TaskEntry) clearTask() {
 	}
 }
 
-func (t *TaskEntry) setList(list *TaskList) {
+func (t *TaskEntry) getList() *TaskList {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.list = list
+	return t.list
 }
 
+// Remove unlinks the entry from its bucket, in O(1).
 func (t *TaskEntry) Remove() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.list != nil {
-		t.list.remove(t)
-		t.list = nil
+	// 加锁顺序是先桶后节点，这里不能持有节点的锁；
+	// 移除的同时任务可能被重新加入别的桶，所以循环直到节点不在任何桶中
+	for list := t.getList(); list != nil; list = t.getList() {
+		list.remove(t)
 	}
 }
 
@@ -111,20 +119,25 @@ func (t *TaskEntry) cancelled() bool {
 	return t.task.GetTaskEntry() != t
 }
 
-func NewTaskList(c *int64) *TaskList {
+func NewTaskList(c *int64, clk clock.Clock) *TaskList {
 	tl := &TaskList{
 		taskCounter: c,
+		clock:       clk,
+		unit:        unit.MILLISECONDS,
 	}
+	tl.root.next = &tl.root
+	tl.root.prev = &tl.root
 	return tl
 }
 
-var mu sync.Mutex
-
+// TaskList 时间轮的桶，任务以双向链表保存，每个桶有自己的锁，加入和移除都是O(1)
 type TaskList struct {
 	mu          sync.Mutex
 	taskCounter *int64
-	entries     []*TaskEntry
-	expiration  int64
+	root        TaskEntry // 哨兵节点，root.next是第一个任务
+	expiration  int64     // 原子读写，延时队列在持有自己的锁时会读取
+	clock       clock.Clock
+	unit        *unit.TimeUnit //expiration的单位，由时间轮设置
 }
 
 // 如果两个时间放到了时间轮的相同层的相同刻度中，刷新过期时间时，要比较是否比之前的过期时间小，如果小的话才更新，
@@ -132,53 +145,78 @@ type TaskList struct {
 // 这样子在N层时间轮之后，时间间隔较大的地方，会出现相差很久的两个任务，却同时执行了
 // 返回值为是否已经放入了延时队列中，防止重复放入
 func (t *TaskList) setExpiration(e int64) bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	old := t.expiration
-	if old == 0 || old == empty || (old != empty && old > e) {
-		t.expiration = e
+	for {
+		old := atomic.LoadInt64(&t.expiration)
+		if old != 0 && old != empty && old <= e {
+			return old == e
+		}
+		if atomic.CompareAndSwapInt64(&t.expiration, old, e) {
+			return false
+		}
 	}
-	return old == e
 }
 
 func (t *TaskList) add(entry *TaskEntry) {
-	mu.Lock()
-	defer mu.Unlock()
-	entry.setList(t)
-	atomic.AddInt64(t.taskCounter, 1)
-	t.entries = append(t.entries, entry)
+	for {
+		// 先从原来的桶中移除，任务在同一时刻只能在一个桶中
+		entry.Remove()
+		t.mu.Lock()
+		entry.mu.Lock()
+		if entry.list == nil {
+			tail := t.root.prev
+			entry.next = &t.root
+			entry.prev = tail
+			entry.list = t
+			tail.next = entry
+			t.root.prev = entry
+			atomic.AddInt64(t.taskCounter, 1)
+			entry.mu.Unlock()
+			t.mu.Unlock()
+			return
+		}
+		entry.mu.Unlock()
+		t.mu.Unlock()
+	}
 }
 
+//移除任务。任务全部被取消的桶留在延时队列中，到期时flush为空，收割器直接跳过
 func (t *TaskList) remove(entry *TaskEntry) {
-	mu.Lock()
-	defer mu.Unlock()
-	if entry.list == t {
-		for idx, e := range t.entries {
-			if e == entry {
-				t.entries[idx] = nil
-				e.list = nil
-				t.entries = append(t.entries[:idx], t.entries[idx+1:]...)
-				break
-			}
-		}
-		atomic.AddInt64(t.taskCounter, -1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(entry)
+}
+
+// removeLocked 将节点从链表中摘除，调用方需持有桶的锁
+func (t *TaskList) removeLocked(entry *TaskEntry) bool {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.list != t {
+		return false
 	}
+	entry.next.prev = entry.prev
+	entry.prev.next = entry.next
+	entry.next = nil
+	entry.prev = nil
+	entry.list = nil
+	atomic.AddInt64(t.taskCounter, -1)
+	return true
 }
 
 var empty int64 = math.MaxInt64
 
 func (t *TaskList) flush() []*TaskEntry {
-	mu.Lock()
-	var entries = make([]*TaskEntry, len(t.entries))
-	copy(entries, t.entries)
-	mu.Unlock()
-	for _, entry := range entries {
-		t.remove(entry)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var entries []*TaskEntry
+	for head := t.root.next; head != &t.root; head = t.root.next {
+		t.removeLocked(head)
+		entries = append(entries, head)
 	}
-	t.expiration = empty
+	atomic.StoreInt64(&t.expiration, empty)
 	return entries
 }
 
+// GetDelay 按纳秒计算，桶在刻度的起点准时到期，不受单位取整的影响
 func (t *TaskList) GetDelay() time.Duration {
-	return time.Duration(t.expiration-unit.HiResClockMs()) * time.Millisecond
+	return t.unit.ToDuration(atomic.LoadInt64(&t.expiration)) - time.Duration(t.clock.Nanos())
 }
@@ -2,9 +2,9 @@ package unit
 
 import (
 	"math"
-	_ "runtime"
 	"time"
-	_ "unsafe"
+
+	"github.com/GuoCeng/time-wheel/clock"
 )
 
 const (
@@ -27,22 +27,18 @@ var (
 	DAYS         = New(DayScale)
 )
 
-// runtimeNano returns the current value of the runtime clock in nanoseconds.
-//go:linkname runtimeNano runtime.nanotime
-func runtimeNano() int64
-
-//获取当前时间int64值，单位为毫秒，精度为毫秒
+//获取当前时间int64值，单位为毫秒，精度为毫秒（单调时钟，取自clock.System）
 func HiResClockMs() int64 {
-	return NANOSECONDS.ToMillis(runtimeNano())
+	return clock.System.Millis()
 }
 
 //获取当前时间int64值，单位为毫秒，精度为秒（忽略毫秒数）
 func ClockMs() int64 {
-	return NANOSECONDS.ToSeconds(runtimeNano()) * 1000
+	return MILLISECONDS.ToSeconds(clock.System.Millis()) * 1000
 }
 
 func GetHiResClockMs(now time.Time) int64 {
-	return NANOSECONDS.ToMillis(runtimeNano())
+	return clock.System.Millis()
 }
 
 type TimeUnit struct {
@@ -152,6 +148,17 @@ func (tu *TimeUnit) ConvertTime(time time.Time) int64 {
 	}
 }
 
+// ConvertDuration converts d to this unit, truncating towards zero.
+func (tu *TimeUnit) ConvertDuration(d time.Duration) int64 {
+	return tu.Convert(int64(d), NANOSECONDS)
+}
+
+// ToDuration converts a duration in this unit to a time.Duration, saturating
+// on overflow.
+func (tu *TimeUnit) ToDuration(duration int64) time.Duration {
+	return time.Duration(tu.ToNanos(duration))
+}
+
 func (tu *TimeUnit) ToNanos(duration int64) int64 {
 	s := tu.scale
 	if s == NanoScale {
@@ -2,22 +2,29 @@ package timer
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
-
+	"github.com/GuoCeng/time-wheel/clock"
+	"github.com/GuoCeng/time-wheel/logging"
 	"github.com/GuoCeng/time-wheel/queue"
+	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
 )
 
+// ErrTimerClosed is returned by Add once the timer has been shut down.
+var ErrTimerClosed = errors.New("timer: timer is shut down")
+
 type Timer interface {
 
 	/**
 	 * Add a new task to this executor. It will be executed after the task's delay
 	 * (beginning from the time of submission)
 	 * @param timerTask the task to add
+	 * @return ErrTimerClosed if the timer has been shut down
 	 */
-	Add(timerTask Task)
+	Add(timerTask Task) error
 
 	/**
 	   * Advance the internal clock, executing any tasks whose expiration has been
@@ -27,6 +34,18 @@ type Timer interface {
 	*/
 	AdvanceClock(ctx context.Context) bool
 
+	/**
+	 * Start the reaper goroutine, which advances the clock so that tasks run
+	 * without the caller calling AdvanceClock. Does nothing if it is already running.
+	 */
+	Start()
+
+	/**
+	 * Stop the reaper goroutine and wait for it to exit. Pending tasks are kept
+	 * and run once the timer is started again.
+	 */
+	Stop()
+
 	/**
 	 * Get the number of tasks pending execution
 	 * @return the number of tasks
@@ -34,97 +53,228 @@ type Timer interface {
 	Size() int64
 
 	/**
-	 * Shutdown the timer service, leaving pending tasks unexecuted
+	 * Shutdown the timer service, leaving pending tasks unexecuted.
+	 * The contexts of the running ContextTasks are cancelled.
+	 * Blocked AdvanceClock calls return, later Add calls fail. Only the first call
+	 * has an effect.
+	 * @return the tasks that were pending execution
 	 */
-	Shutdown()
+	Shutdown() []Task
+
+	/**
+	 * Get the unit of the delays of the tasks
+	 * @return the time unit of the timer
+	 */
+	Unit() *unit.TimeUnit
 }
 
-func NewSystemTimer(tickMs int64, wheelSize int) *SystemTimer {
-	startMs := unit.ClockMs()
-	q := queue.NewDelay()
-	c := new(int64)
-	return &SystemTimer{
-		tickMs:      tickMs,
-		wheelSize:   wheelSize,
-		startMs:     startMs,
-		delayQueue:  q,
-		taskCounter: c,
-		timingWheel: NewTimingWheel(tickMs, wheelSize, startMs, c, q),
+// NewSystemTimer returns a timer backed by a hierarchical timing wheel,
+// configured by the given options.
+func NewSystemTimer(opts ...Option) *SystemTimer {
+	t := &SystemTimer{
+		tickSize:    time.Millisecond,
+		unit:        unit.MILLISECONDS,
+		wheelSize:   20,
+		taskCounter: new(int64),
+		clock:       clock.System,
+		executor:    GoExecutor{},
+		logger:      logging.DefaultLogger,
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
+	if t.tick = t.unit.ConvertDuration(t.tickSize); t.tick <= 0 {
+		panic("timer: tick shorter than the time unit")
+	}
+	t.clock = alignToWall(t.clock)
+	t.delayQueue = queue.NewDelayOf[*TaskList](queue.WithClock(t.clock))
+	t.ctx, t.cancelCtx = context.WithCancel(context.Background())
+	t.start = t.now()
+	t.timingWheel = NewTimingWheel(t.tick, t.wheelSize, t.start, t.taskCounter, t.delayQueue, t.clock, t.unit)
+	return t
 }
 
 type SystemTimer struct {
 	mu          sync.RWMutex
-	tickMs      int64
+	tickSize    time.Duration
+	tick        int64 //tickSize换算为unit
+	unit        *unit.TimeUnit
 	wheelSize   int
-	startMs     int64
-	delayQueue  *queue.DelayQueue
+	start       int64
+	ctx         context.Context //ContextTask的上下文的父节点，Shutdown时取消
+	cancelCtx   context.CancelFunc
+	delayQueue  *queue.DelayQueueOf[*TaskList]
 	taskCounter *int64
 	timingWheel *TimingWheel
+	clock       clock.Clock
+	executor    Executor
+	logger      logging.Logger
+	closed      bool
+	reaperMu    sync.Mutex
+	reaperStop  context.CancelFunc
+	reaperDone  chan struct{}
 }
 
-func (t *SystemTimer) Add(task Task) {
+func (t *SystemTimer) Add(task Task) error {
 	t.mu.RLock()
-	defer t.mu.RUnlock()
+	if t.closed {
+		t.mu.RUnlock()
+		return ErrTimerClosed
+	}
 	var entry *TaskEntry
 	if entry = task.GetTaskEntry(); entry == nil {
-		entry = NewTaskEntry(task, unit.ClockMs()+task.GetDelay())
+		entry = NewTaskEntry(task, t.now()+task.GetDelay())
 	} else {
-		entry.exp = unit.ClockMs() + task.GetDelay()
+		entry.exp = t.now() + task.GetDelay()
+	}
+	expired := t.addTimerTaskEntry(entry)
+	t.mu.RUnlock()
+	if expired {
+		t.executor.Execute(task.Run)
 	}
-	t.addTimerTaskEntry(entry)
+	return nil
 }
 
-//将任务插入时间轮中，如果发现任务超时，则执行
-func (t *SystemTimer) addTimerTaskEntry(taskEntry *TaskEntry) {
+//将任务插入时间轮中，返回任务是否已经超时，超时的任务由调用方在释放锁之后执行
+func (t *SystemTimer) addTimerTaskEntry(taskEntry *TaskEntry) bool {
 	if !t.timingWheel.add(taskEntry) {
 		// Already expired or cancelled
-		if !taskEntry.cancelled() {
-			go func() {
-				taskEntry.task.Run()
-			}()
-		}
+		return !taskEntry.cancelled()
 	}
+	return false
 }
 
 // Advances the clock if there is an expired bucket. If there isn't any expired bucket when called,
 // waits up to timeoutMs before giving up.
-// 收割时间轮，通过延时队列获取对象，如果未返回，则表明未到收割时间，返回的话，就将各圈中的任务进行重新分配，分配过程中将已过期的任务执行掉
+// 收割时间轮，通过延时队列获取对象，如果未返回，则表明未到收割时间，返回的话，就将各圈中的任务进行重新分配，分配过程中将已过期的任务交给executor执行
 func (t *SystemTimer) AdvanceClock(ctx context.Context) bool {
-	bucket := t.delayQueue.Pop(ctx)
-	if bucket != nil {
-		if v, ok := bucket.(*TaskList); ok {
-			t.mu.Lock()
-			defer t.mu.Unlock()
-			for v != nil {
-				//推进时间轮时间
-				t.timingWheel.advanceClock(unit.HiResClockMs())
-				//刷新对象，将时间轮各圈中的对象，重新分配各圈中相应的位置
-				entries := v.flush()
-				for _, e := range entries {
-					if e != nil {
-						t.addTimerTaskEntry(e)
-					}
-				}
-				x := t.delayQueue.Poll()
-				if x != nil {
-					v = x.(*TaskList)
-				} else {
-					v = nil
-				}
+	bucket, ok := t.delayQueue.Pop(ctx)
+	if !ok {
+		return false
+	}
+	var expired []*TaskEntry
+	t.mu.Lock()
+	if t.closed {
+		// 收割期间定时器已关闭，桶中的任务已由Shutdown返回
+		t.mu.Unlock()
+		return false
+	}
+	for ok {
+		//推进时间轮时间
+		t.timingWheel.advanceClock(t.now())
+		//刷新对象，将时间轮各圈中的对象，重新分配各圈中相应的位置
+		entries := bucket.flush()
+		for _, e := range entries {
+			if e != nil && t.addTimerTaskEntry(e) {
+				expired = append(expired, e)
 			}
-			return true
-		} else {
-			panic("did not found TaskList")
 		}
+		bucket, ok = t.delayQueue.Poll()
 	}
-	return false
+	t.mu.Unlock()
+	if len(expired) > 0 {
+		t.logger.Info("advance clock", "currentTime", t.timingWheel.currentTime, "expired", len(expired))
+	}
+	// 在锁外执行，任务中可以再次调用Add（如cron的Entry），同步的executor也不会死锁
+	for _, e := range expired {
+		t.executor.Execute(e.task.Run)
+	}
+	return true
+}
+
+// Start starts the reaper goroutine (时间收割器), which keeps advancing the
+// clock until Stop or Shutdown is called. It does nothing if the reaper is
+// already running or the timer has been shut down.
+func (t *SystemTimer) Start() {
+	t.reaperMu.Lock()
+	defer t.reaperMu.Unlock()
+	if t.reaperStop != nil || t.isClosed() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.reaperStop, t.reaperDone = cancel, make(chan struct{})
+	go t.reap(ctx, t.reaperDone)
+}
+
+// Stop stops the reaper goroutine and waits for it to exit. Tasks that are
+// already running are not waited for. Stop must not be called from a task
+// run by a SyncExecutor, as that task runs on the reaper goroutine itself.
+func (t *SystemTimer) Stop() {
+	t.reaperMu.Lock()
+	defer t.reaperMu.Unlock()
+	if t.reaperStop == nil {
+		return
+	}
+	t.reaperStop()
+	<-t.reaperDone
+	t.reaperStop, t.reaperDone = nil, nil
+}
+
+//收割器循环推进时间轮，直到被停止或定时器关闭
+func (t *SystemTimer) reap(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for ctx.Err() == nil && !t.isClosed() {
+		//延时队列在新的桶成为堆顶时会唤醒等待者，无需限制单次等待时间
+		t.AdvanceClock(ctx)
+	}
+}
+
+// wallClock 将时钟的单调时间平移为Unix时间，使桶的刻度与墙上时间的整秒等对齐。
+// 否则刻度为1秒时，整秒到期的任务（如cron的Entry）最多会提前一个刻度执行
+type wallClock struct {
+	clock.Clock
+	offset int64
+}
+
+// alignToWall 先读墙上时间再读单调时间，平移量的误差只会让任务稍晚而不会提前执行
+func alignToWall(c clock.Clock) clock.Clock {
+	wall := c.Now().UnixNano()
+	return wallClock{Clock: c, offset: wall - c.Nanos()}
+}
+
+func (c wallClock) Nanos() int64 {
+	return c.Clock.Nanos() + c.offset
+}
+
+func (c wallClock) Millis() int64 {
+	return c.Nanos() / int64(time.Millisecond)
+}
+
+// now 时钟的当前时间，单位为unit
+func (t *SystemTimer) now() int64 {
+	return t.unit.Convert(t.clock.Nanos(), unit.NANOSECONDS)
+}
+
+// Unit returns the unit of the delays of the tasks, see WithTimeUnit.
+func (t *SystemTimer) Unit() *unit.TimeUnit {
+	return t.unit
+}
+
+func (t *SystemTimer) isClosed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.closed
 }
 
 func (t *SystemTimer) Size() int64 {
 	return atomic.LoadInt64(t.taskCounter)
 }
 
-func (t *SystemTimer) Shutdown() {
+func (t *SystemTimer) Shutdown() []Task {
+	t.Stop()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	t.cancelCtx()
 	t.delayQueue.Release()
+	var tasks []Task
+	for _, e := range t.timingWheel.flush() {
+		if !e.cancelled() {
+			tasks = append(tasks, e.task)
+		}
+	}
+	return tasks
 }
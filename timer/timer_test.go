@@ -2,45 +2,650 @@ package timer
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/GuoCeng/time-wheel/clock"
+	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
 )
 
+// advance 推进假时钟，并收割所有到期的任务
+func advance(timer *SystemTimer, clk *clock.FakeClock, d time.Duration) {
+	clk.Advance(d)
+	//已取消的ctx使AdvanceClock只处理到期的桶，不会阻塞
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for timer.AdvanceClock(ctx) {
+	}
+}
+
 func TestSystemTimer_AdvanceClock(t *testing.T) {
-	timer := NewSystemTimer(1, 20)
-	fmt.Printf("开始时间：%v \n", time.Now())
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
 
-	timer.Add(NewSimpleTask(1, 1000, func() {
-		fmt.Printf("%v-执行时间：%v \n", 1, time.Now())
-	}))
+	ranAt := make(map[int64]int64)
+	for i := int64(1); i <= 5; i++ {
+		id := i
+		timer.Add(NewSimpleTask(id, id*1000, func() {
+			ranAt[id] = clk.Millis()
+		}))
+	}
+	if timer.Size() != 5 {
+		t.Fatalf("expected 5 pending tasks, got %d", timer.Size())
+	}
 
-	timer.Add(NewSimpleTask(2, 2000, func() {
-		fmt.Printf("%v-执行时间：%v \n", 2, time.Now())
-	}))
+	for i := int64(1); i <= 5; i++ {
+		advance(timer, clk, 999*time.Millisecond)
+		if _, ok := ranAt[i]; ok {
+			t.Fatalf("expected task %d not to run before its expiration", i)
+		}
+		advance(timer, clk, time.Millisecond)
+		if ranAt[i] != i*1000 {
+			t.Fatalf("expected task %d to run at %dms, got %v", i, i*1000, ranAt)
+		}
+		if timer.Size() != 5-i {
+			t.Fatalf("expected %d pending tasks, got %d", 5-i, timer.Size())
+		}
+	}
+}
 
-	timer.Add(NewSimpleTask(3, 3000, func() {
-		fmt.Printf("%v-执行时间：%v \n", 3, time.Now())
-	}))
+func TestSystemTimer_WallAlignedTick(t *testing.T) {
+	// 假时钟从整秒之后300ms开始，刻度为1秒的桶仍按墙上时间的整秒到期
+	start := time.Date(2020, 1, 1, 0, 0, 0, int(300*time.Millisecond), time.UTC)
+	clk := clock.NewFake(start)
+	timer := NewSystemTimer(WithTickMs(1000), WithWheelSize(60), WithClock(clk), WithExecutor(SyncExecutor{}))
 
-	timer.Add(NewSimpleTask(4, 4000, func() {
-		fmt.Printf("%v-执行时间：%v \n", 4, time.Now())
+	var ranAt []time.Time
+	for _, delay := range []int64{700, 1700} {
+		timer.Add(NewSimpleTask(delay, delay, func() {
+			ranAt = append(ranAt, clk.Now())
+		}))
+	}
+	if len(ranAt) != 0 {
+		t.Fatalf("expected no task to run before its expiration, got %v", ranAt)
+	}
+	for i := 0; i < 20; i++ {
+		advance(timer, clk, 100*time.Millisecond)
+	}
+	if len(ranAt) != 2 || !ranAt[0].Equal(start.Add(700*time.Millisecond)) || !ranAt[1].Equal(start.Add(1700*time.Millisecond)) {
+		t.Fatalf("expected the tasks to run on the whole seconds, got %v", ranAt)
+	}
+}
+
+func TestSyncExecutor(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	var runs []int64
+	// 已经超时的任务在Add中同步执行，任务中再次调用Add不会死锁
+	timer.Add(NewSimpleTask(1, -1000, func() {
+		runs = append(runs, 1)
+		timer.Add(NewSimpleTask(2, -1000, func() {
+			runs = append(runs, 2)
+		}))
 	}))
+	if len(runs) != 2 || runs[0] != 1 || runs[1] != 2 {
+		t.Fatalf("expected tasks 1 and 2 to run synchronously, got %v", runs)
+	}
 
-	timer.Add(NewSimpleTask(5, 5000, func() {
-		fmt.Printf("%v-执行时间：%v \n", 5, time.Now())
+	done := false
+	timer.Add(NewSimpleTask(3, 1500, func() {
+		timer.Add(NewSimpleTask(4, -1000, func() {
+			done = true
+		}))
 	}))
+	advance(timer, clk, 1500*time.Millisecond)
+	if !done {
+		t.Fatal("expected task added from a running task to be executed")
+	}
+}
+
+func TestPoolExecutor(t *testing.T) {
+	executor, err := NewPoolExecutor(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer executor.Release()
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(executor))
+
+	var running, max int64
+	var wg sync.WaitGroup
+	started, finish := make(chan struct{}, 10), make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		timer.Add(NewSimpleTask(int64(i), 1000, func() {
+			defer wg.Done()
+			n := atomic.AddInt64(&running, 1)
+			for {
+				m := atomic.LoadInt64(&max)
+				if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+					break
+				}
+			}
+			started <- struct{}{}
+			<-finish
+			atomic.AddInt64(&running, -1)
+		}))
+	}
+	// 两个任务占满了池，收割器在提交第三个任务时阻塞
+	advanced := make(chan struct{})
+	go func() {
+		advance(timer, clk, time.Second)
+		close(advanced)
+	}()
+	<-started
+	<-started
+	if n := executor.Running(); n != 2 {
+		t.Fatalf("expected 2 tasks running, got %d", n)
+	}
+	close(finish)
+	wg.Wait()
+	<-advanced
+	if max > 2 {
+		t.Errorf("expected at most 2 tasks running at once, got %d", max)
+	}
+
+	// 释放之后的任务被拒绝，交给OnReject处理
+	executor.Release()
+	var rejected error
+	executor.OnReject = func(f func(), err error) { rejected = err }
+	executor.Execute(func() { t.Error("expected the rejected task not to run") })
+	if rejected == nil {
+		t.Error("expected the task to be rejected after Release")
+	}
+	ran := false
+	executor.OnReject = CallerRuns
+	executor.Execute(func() { ran = true })
+	if !ran {
+		t.Error("expected CallerRuns to run the task on the caller")
+	}
+}
+
+func TestSystemTimerOptions(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1, 0))
+	timer := NewSystemTimer(WithTickMs(10), WithWheelSize(8), WithClock(clk), WithExecutor(SyncExecutor{}))
+	if timer.tick != 10 || timer.wheelSize != 8 || timer.timingWheel.interval != 80 {
+		t.Fatalf("unexpected wheel geometry: tick %v, size %v, interval %v", timer.tick, timer.wheelSize, timer.timingWheel.interval)
+	}
+
+	var ran []int64
+	for _, delay := range []int64{50, 200, 1000} {
+		id := delay
+		timer.Add(NewSimpleTask(id, delay, func() {
+			ran = append(ran, id)
+		}))
+	}
+	if timer.Size() != 3 {
+		t.Fatalf("expected 3 pending tasks, got %d", timer.Size())
+	}
 
+	advance(timer, clk, 40*time.Millisecond)
+	if len(ran) != 0 {
+		t.Fatalf("expected no task to run before its expiration, got %v", ran)
+	}
+	advance(timer, clk, 10*time.Millisecond)
+	if len(ran) != 1 || ran[0] != 50 {
+		t.Fatalf("expected task 50 to run, got %v", ran)
+	}
+	advance(timer, clk, 150*time.Millisecond)
+	if len(ran) != 2 || ran[1] != 200 {
+		t.Fatalf("expected task 200 to run, got %v", ran)
+	}
+	advance(timer, clk, 800*time.Millisecond)
+	if len(ran) != 3 || ran[2] != 1000 || timer.Size() != 0 {
+		t.Fatalf("expected task 1000 to run, got %v with %d pending", ran, timer.Size())
+	}
+}
+
+func TestSystemTimer_MicrosecondTick(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1, 0))
+	tick := 100 * time.Microsecond
+	timer := NewSystemTimer(WithTimeUnit(unit.MICROSECONDS), WithTick(tick), WithClock(clk), WithExecutor(SyncExecutor{}))
+	if timer.tick != 100 || timer.Unit() != unit.MICROSECONDS {
+		t.Fatalf("expected a tick of 100µs, got %d", timer.tick)
+	}
+
+	delays := []int64{250, 1000, 1050, 7300, 45000}
+	ranAt := make(map[int64]time.Duration)
+	for _, delay := range delays {
+		id := delay
+		timer.Add(NewSimpleTask(id, delay, func() {
+			ranAt[id] = time.Duration(clk.Nanos())
+		}))
+	}
+	// 以远小于刻度的步长推进，任务最多提前一个刻度执行，且不会迟于到期后的一个步长
+	step := 10 * time.Microsecond
+	for i := 0; i < 5000; i++ {
+		advance(timer, clk, step)
+	}
+	for _, delay := range delays {
+		exp := time.Duration(delay) * time.Microsecond
+		at, ok := ranAt[delay]
+		if !ok {
+			t.Fatalf("expected task %dµs to run", delay)
+		}
+		if at < exp-tick || at > exp+step {
+			t.Errorf("expected task %dµs to run within [%v, %v], ran at %v", delay, exp-tick, exp+step, at)
+		}
+	}
+}
+
+func TestSystemTimer_Jitter(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1, 0))
+	tick := 100 * time.Microsecond
+	timer := NewSystemTimer(WithTimeUnit(unit.MICROSECONDS), WithTick(tick), WithClock(clk), WithExecutor(SyncExecutor{}))
+	// 远期的任务使收割器总是在时钟上等待，BlockUntil可以判断收割器是否空闲
+	timer.Add(NewSimpleTask(0, int64(time.Second/time.Microsecond), func() {}))
+	timer.Start()
+	defer timer.Shutdown()
+
+	const n = 50
+	var mu sync.Mutex
+	ranAt := make(map[int]time.Time)
+	start := clk.Now()
+	for i := 0; i < n; i++ {
+		i, delay := i, int64(500+i*100)
+		timer.Add(NewSimpleTask(int64(i+1), delay, func() {
+			mu.Lock()
+			ranAt[i] = clk.Now()
+			mu.Unlock()
+		}))
+	}
+	// 收割器推进时间轮，提前不超过一个刻度，且不迟于到期后的一个步长
+	step := 10 * time.Microsecond
+	for clk.Now().Sub(start) < 6*time.Millisecond {
+		clk.BlockUntil(1)
+		clk.Advance(step)
+	}
+	clk.BlockUntil(1)
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < n; i++ {
+		exp := start.Add(time.Duration(500+i*100) * time.Microsecond)
+		at, ok := ranAt[i]
+		if !ok {
+			t.Fatalf("expected task %d to run", i)
+		}
+		if at.Before(exp.Add(-tick)) || at.After(exp.Add(step)) {
+			t.Errorf("expected task %d to run within [-%v, %v] of its expiration, ran %v after it", i, tick, step, at.Sub(exp))
+		}
+	}
+}
+
+func TestSystemTimer_Shutdown(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithTickMs(10), WithWheelSize(8), WithClock(clk))
+	for i := int64(1); i <= 3; i++ {
+		timer.Add(NewSimpleTask(i, i*1000, func() {
+			t.Error("expected pending task not to run after Shutdown")
+		}))
+	}
+	cancelled := NewSimpleTask(4, 500, func() {})
+	timer.Add(cancelled)
+	cancelled.Cancel()
+
+	advanced := make(chan bool)
 	go func() {
-		fmt.Printf("task counter: %v\n", timer.Size())
-		for timer.Size() > 0 {
-			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
-			timer.AdvanceClock(ctx)
-			log.Println("执行一次收割", timer.timingWheel.currentTime)
-			cancel()
-		}
-		fmt.Printf("task counter: %v\n", timer.Size())
+		advanced <- timer.AdvanceClock(context.Background())
 	}()
-	time.Sleep(60 * time.Second)
+	//等待AdvanceClock阻塞在第一个桶的到期时间上
+	clk.BlockUntil(1)
+
+	var wg sync.WaitGroup
+	results := make([][]Task, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = timer.Shutdown()
+		}(i)
+	}
+	wg.Wait()
+	var pending []Task
+	for _, r := range results {
+		if r != nil {
+			if pending != nil {
+				t.Fatal("expected only one Shutdown call to return the pending tasks")
+			}
+			pending = r
+		}
+	}
+	if len(pending) != 3 {
+		t.Fatalf("expected 3 pending tasks, got %d", len(pending))
+	}
+	if timer.Size() != 0 {
+		t.Errorf("expected no task left in the wheel, got %d", timer.Size())
+	}
+
+	if <-advanced {
+		t.Error("expected AdvanceClock to return false after Shutdown")
+	}
+	if err := timer.Add(NewSimpleTask(5, -1000, func() {
+		t.Error("expected task added after Shutdown not to run")
+	})); err != ErrTimerClosed {
+		t.Errorf("expected ErrTimerClosed, got %v", err)
+	}
+}
+
+func TestSystemTimer_StartStop(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithTickMs(10), WithWheelSize(8), WithClock(clk), WithExecutor(SyncExecutor{}))
+	ran := make(chan int64, 3)
+	for _, delay := range []int64{20, 100, 300} {
+		id := delay
+		timer.Add(NewSimpleTask(id, delay, func() { ran <- id }))
+	}
+
+	timer.Start()
+	timer.Start()
+	for _, expected := range []int64{20, 100} {
+		//收割器等待堆顶的桶到期之后再推进时钟
+		clk.BlockUntil(1)
+		clk.Advance(time.Duration(expected)*time.Millisecond - clk.Now().Sub(time.Unix(0, 0)))
+		if id := <-ran; id != expected {
+			t.Fatalf("expected task %d to run, got %d", expected, id)
+		}
+	}
+
+	// 停止之后任务保留，重新启动后继续执行
+	timer.Stop()
+	timer.Stop()
+	clk.Advance(time.Second)
+	if len(ran) != 0 || timer.Size() != 1 {
+		t.Fatalf("expected no task to run while stopped and 1 pending task, got %d run and %d pending", len(ran), timer.Size())
+	}
+	timer.Start()
+	if id := <-ran; id != 300 {
+		t.Fatalf("expected task 300 to run, got %d", id)
+	}
+
+	timer.Shutdown()
+	timer.Start()
+	if timer.reaperStop != nil {
+		t.Error("expected Start to do nothing after Shutdown")
+	}
+}
+
+func TestSystemTimer_CancelKeepsBucket(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	first := NewSimpleTask(1, 5, func() { t.Error("expected cancelled task not to run") })
+	second := NewSimpleTask(2, 5, func() { t.Error("expected cancelled task not to run") })
+	timer.Add(first)
+	timer.Add(second)
+	if timer.delayQueue.Len() != 1 {
+		t.Fatalf("expected the bucket to be in the delay queue, got %d buckets", timer.delayQueue.Len())
+	}
+
+	// 取消不访问延时队列，清空的桶留到到期时被跳过
+	first.Cancel()
+	second.Cancel()
+	if timer.delayQueue.Len() != 1 || timer.Size() != 0 {
+		t.Fatalf("expected the empty bucket to stay queued, got %d buckets and %d tasks", timer.delayQueue.Len(), timer.Size())
+	}
+
+	// 同一周期内再次使用该桶，不会重复入队
+	ran := false
+	timer.Add(NewSimpleTask(3, 5, func() { ran = true }))
+	if timer.delayQueue.Len() != 1 {
+		t.Fatalf("expected the reused bucket to be queued once, got %d buckets", timer.delayQueue.Len())
+	}
+	advance(timer, clk, 5*time.Millisecond)
+	if !ran || timer.delayQueue.Len() != 0 {
+		t.Errorf("expected the task added to the reused bucket to run, ran %v with %d buckets left", ran, timer.delayQueue.Len())
+	}
+
+	// 只有已取消任务的桶到期时，收割器不执行任何任务
+	cancelled := NewSimpleTask(4, 5, func() { t.Error("expected cancelled task not to run") })
+	timer.Add(cancelled)
+	cancelled.Cancel()
+	advance(timer, clk, 5*time.Millisecond)
+	if timer.delayQueue.Len() != 0 {
+		t.Errorf("expected the empty bucket to be dropped once due, got %d buckets", timer.delayQueue.Len())
+	}
+}
+
+func TestTaskList_AddRemove(t *testing.T) {
+	var counter int64
+	clk := clock.NewFake(time.Unix(0, 0))
+	a, b := NewTaskList(&counter, clk), NewTaskList(&counter, clk)
+	var entries []*TaskEntry
+	for i := 0; i < 3; i++ {
+		entry := NewTaskEntry(NewSimpleTask(int64(i), 0, func() {}), 0)
+		a.add(entry)
+		entries = append(entries, entry)
+	}
+
+	entries[1].Remove()
+	entries[1].Remove()
+	if counter != 2 {
+		t.Fatalf("expected 2 tasks after removing one twice, got %d", counter)
+	}
+	// 加入另一个桶时，先从原来的桶中移除
+	b.add(entries[2])
+	if counter != 2 || entries[2].list != b {
+		t.Fatalf("expected the task to move to the other bucket, got %d tasks", counter)
+	}
+
+	flushed := a.flush()
+	if len(flushed) != 1 || flushed[0] != entries[0] || counter != 1 {
+		t.Fatalf("expected the first task to be flushed, got %d tasks", len(flushed))
+	}
+	if a.root.next != &a.root || a.root.prev != &a.root {
+		t.Error("expected the flushed bucket to be empty")
+	}
+}
+
+func BenchmarkTaskList_AddRemove_1M(b *testing.B) {
+	var counter int64
+	list := NewTaskList(&counter, clock.System)
+	entries := make([]*TaskEntry, 1000000)
+	for i := range entries {
+		entries[i] = NewTaskEntry(NewSimpleTask(int64(i), 0, func() {}), 0)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, entry := range entries {
+			list.add(entry)
+		}
+		// 从中间开始交替移除，避免总是移除表头
+		for i := len(entries) / 2; i < len(entries); i++ {
+			entries[i].Remove()
+			entries[len(entries)-1-i].Remove()
+		}
+	}
+}
+
+func BenchmarkSystemTimer_AddCancel_1M(b *testing.B) {
+	timer := NewSystemTimer(WithClock(clock.NewFake(time.Unix(0, 0))))
+	tasks := make([]*SimpleTask, 1000000)
+	for i := range tasks {
+		tasks[i] = NewSimpleTask(int64(i), int64(i%100000)+1, func() {})
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, task := range tasks {
+			timer.Add(task)
+		}
+		for _, task := range tasks {
+			task.Cancel()
+		}
+	}
+}
+
+func TestSystemTimer_AfterFunc(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	runs := 0
+	h := timer.AfterFunc(10*time.Millisecond, func() { runs++ })
+	if !h.Deadline().Equal(clk.Now().Add(10 * time.Millisecond)) {
+		t.Fatalf("unexpected deadline %v", h.Deadline())
+	}
+
+	advance(timer, clk, 9*time.Millisecond)
+	select {
+	case <-h.Done():
+		t.Fatal("expected Done to stay open before the deadline")
+	default:
+	}
+	advance(timer, clk, time.Millisecond)
+	<-h.Done()
+	if runs != 1 || h.Cancel() {
+		t.Fatalf("expected one run and Cancel to fail afterwards, got %d runs", runs)
+	}
+
+	// 与time.Timer相同，执行之后Reset会再次执行
+	if h.Reset(5 * time.Millisecond) {
+		t.Error("expected Reset of a handle that already ran to return false")
+	}
+	advance(timer, clk, 5*time.Millisecond)
+	<-h.Done()
+	if runs != 2 {
+		t.Fatalf("expected the reset handle to run again, got %d runs", runs)
+	}
+}
+
+func TestHandle_CancelReset(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	var ran []int64
+	cancelled := timer.Schedule(NewSimpleTask(1, 10, func() { ran = append(ran, 1) }))
+	reset := timer.Schedule(NewSimpleTask(2, 10, func() { ran = append(ran, 2) }))
+
+	if !cancelled.Cancel() || cancelled.Cancel() {
+		t.Fatal("expected only the first Cancel to stop the task")
+	}
+	<-cancelled.Done()
+	if !reset.Reset(30 * time.Millisecond) {
+		t.Fatal("expected Reset of a pending handle to return true")
+	}
+	if timer.Size() != 1 {
+		t.Fatalf("expected the reset task to replace the previous one, got %d tasks", timer.Size())
+	}
+
+	advance(timer, clk, 20*time.Millisecond)
+	if len(ran) != 0 {
+		t.Fatalf("expected no task to run, got %v", ran)
+	}
+	advance(timer, clk, 10*time.Millisecond)
+	if len(ran) != 1 || ran[0] != 2 {
+		t.Fatalf("expected the reset task to run at its new deadline, got %v", ran)
+	}
+
+	timer.Shutdown()
+	closed := timer.AfterFunc(time.Millisecond, func() { t.Error("expected no run on a shut down timer") })
+	select {
+	case <-closed.Done():
+	default:
+		t.Error("expected Done to be closed when the timer is shut down")
+	}
+}
+
+func TestSystemTimer_ScheduleAtFixedRate(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	start := clk.Now()
+	var ranAt []time.Duration
+	h := timer.ScheduleAtFixedRate(10*time.Millisecond, 10*time.Millisecond, func() {
+		ranAt = append(ranAt, clk.Now().Sub(start))
+		// 执行耗时不影响后续的执行时间
+		clk.Advance(3 * time.Millisecond)
+	}, WithMaxRuns(4))
+
+	for i := 0; i < 60; i++ {
+		advance(timer, clk, time.Millisecond)
+	}
+	<-h.Done()
+	expected := []time.Duration{10, 20, 30, 40}
+	if len(ranAt) != len(expected) {
+		t.Fatalf("expected %d runs, got %v", len(expected), ranAt)
+	}
+	for i, ms := range expected {
+		if ranAt[i] != ms*time.Millisecond {
+			t.Errorf("expected run %d at %dms, got %v", i, ms, ranAt[i])
+		}
+	}
+	if timer.Size() != 0 {
+		t.Errorf("expected no pending task after the last run, got %d", timer.Size())
+	}
+}
+
+func TestSystemTimer_ScheduleWithFixedDelay(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	start := clk.Now()
+	var ranAt []time.Duration
+	h := timer.ScheduleWithFixedDelay(0, 10*time.Millisecond, func() {
+		ranAt = append(ranAt, clk.Now().Sub(start))
+		clk.Advance(5 * time.Millisecond)
+	}, WithEndTime(start.Add(40*time.Millisecond)))
+
+	for i := 0; i < 60; i++ {
+		advance(timer, clk, time.Millisecond)
+	}
+	<-h.Done()
+	// 每次在上次执行结束后10ms执行，45ms超过了结束时间
+	expected := []time.Duration{0, 15, 30}
+	if len(ranAt) != len(expected) {
+		t.Fatalf("expected %d runs, got %v", len(expected), ranAt)
+	}
+	for i, ms := range expected {
+		if ranAt[i] != ms*time.Millisecond {
+			t.Errorf("expected run %d at %dms, got %v", i, ms, ranAt[i])
+		}
+	}
+}
+
+func TestSystemTimer_CancelPeriodic(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk), WithExecutor(SyncExecutor{}))
+	runs := 0
+	var h *Handle
+	h = timer.ScheduleAtFixedRate(0, 10*time.Millisecond, func() {
+		runs++
+		if runs == 2 && !h.Cancel() {
+			t.Error("expected Cancel during a run to stop the periodic task")
+		}
+	})
+	advance(timer, clk, 50*time.Millisecond)
+	<-h.Done()
+	if runs != 2 || timer.Size() != 0 {
+		t.Fatalf("expected the task to stop after 2 runs, got %d runs and %d pending", runs, timer.Size())
+	}
+	if h.Cancel() {
+		t.Error("expected Cancel of a stopped task to return false")
+	}
+}
+
+func TestSystemTimer_ScheduleContext(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	timer := NewSystemTimer(WithClock(clk))
+	started := make(chan TaskInfo)
+	run := func(ctx context.Context) {
+		info, _ := TaskInfoFrom(ctx)
+		started <- info
+		<-ctx.Done()
+	}
+	cancelled := timer.ScheduleContext(NewContextTask(1, 10, run))
+	shutdown := timer.ScheduleContext(NewContextTask(2, 20, run))
+
+	// 任务在执行中被取消时，上下文随之取消
+	advance(timer, clk, 10*time.Millisecond)
+	if info := <-started; info.ID != 1 || !info.Scheduled.Equal(time.Unix(0, 0).Add(10*time.Millisecond)) {
+		t.Fatalf("unexpected task info %+v", info)
+	}
+	if cancelled.Cancel() {
+		t.Error("expected Cancel of a running task to return false")
+	}
+	<-cancelled.Done()
+
+	// Shutdown取消正在执行的任务的上下文
+	advance(timer, clk, 10*time.Millisecond)
+	if info := <-started; info.ID != 2 {
+		t.Fatalf("expected task 2 to run, got %+v", info)
+	}
+	timer.Shutdown()
+	<-shutdown.Done()
 }
@@ -3,49 +3,57 @@ package timer
 import (
 	"sync"
 
-	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
-
+	"github.com/GuoCeng/time-wheel/clock"
 	"github.com/GuoCeng/time-wheel/queue"
+	unit "github.com/GuoCeng/time-wheel/timer/time-unit"
 )
 
 type TimingWheel struct {
 	mu            sync.Mutex
-	tickMs        int64             //刻度（精度毫秒）
-	wheelSize     int               //时间轮每圈的大小
-	startMs       int64             //开始时间（单位毫秒）
-	taskCounter   *int64            //总任务数
-	q             *queue.DelayQueue //延时队列
-	interval      int64             //当前圈的时间跨度（单位毫秒）
-	buckets       []*TaskList       //当前圈的任务列表
-	currentTime   int64             //当前圈保持的当前时间（由时间轮进行推进）
-	overflowWheel *TimingWheel      //超过当前圈时间跨度时，会创建新的圈
+	tick          int64                          //刻度（即精度，单位为unit）
+	wheelSize     int                            //时间轮每圈的大小
+	start         int64                          //开始时间（单位为unit）
+	taskCounter   *int64                         //总任务数
+	q             *queue.DelayQueueOf[*TaskList] //延时队列
+	interval      int64                          //当前圈的时间跨度（单位为unit）
+	buckets       []*TaskList                    //当前圈的任务列表
+	currentTime   int64                          //当前圈保持的当前时间（由时间轮进行推进）
+	overflowWheel *TimingWheel                   //超过当前圈时间跨度时，会创建新的圈
+	clock         clock.Clock                    //时钟，用于计算任务列表的剩余延时
+	unit          *unit.TimeUnit                 //时间轮中所有时间的单位
 }
 
-func NewTimingWheel(tickMs int64, wheelSize int, startMs int64, c *int64, q *queue.DelayQueue) *TimingWheel {
+// NewTimingWheel returns a wheel of wheelSize buckets of tick each, starting
+// at start. Times are expressed in u, see WithTimeUnit.
+func NewTimingWheel(tick int64, wheelSize int, start int64, c *int64, q *queue.DelayQueueOf[*TaskList], clk clock.Clock, u *unit.TimeUnit) *TimingWheel {
 	buckets := make([]*TaskList, wheelSize)
 	for i := 0; i < wheelSize; i++ {
-		buckets[i] = NewTaskList(c)
+		buckets[i] = NewTaskList(c, clk)
+		buckets[i].unit = u
 	}
 	timingWheel := &TimingWheel{
-		tickMs:      tickMs,
+		tick:        tick,
 		wheelSize:   wheelSize,
-		startMs:     startMs,
+		start:       start,
 		taskCounter: c,
 		q:           q,
-		interval:    tickMs * int64(wheelSize),
+		interval:    tick * int64(wheelSize),
 		buckets:     buckets,
-		currentTime: startMs - (startMs % tickMs),
+		currentTime: start - (start % tick),
+		clock:       clk,
+		unit:        u,
 	}
 	return timingWheel
 }
 
-//
-func (t *TimingWheel) addOverflowWheel() {
+//获取上一层时间轮，不存在时创建；SystemTimer.Add会并发调用，所以需要加锁
+func (t *TimingWheel) getOverflowWheel() *TimingWheel {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.overflowWheel == nil {
-		t.overflowWheel = NewTimingWheel(t.interval, t.wheelSize, t.currentTime, t.taskCounter, t.q)
+		t.overflowWheel = NewTimingWheel(t.interval, t.wheelSize, t.currentTime, t.taskCounter, t.q, t.clock, t.unit)
 	}
+	return t.overflowWheel
 }
 
 //添加任务，将任务添加到对应时间轮的圈的位置
@@ -54,43 +62,52 @@ func (t *TimingWheel) add(entry *TaskEntry) bool {
 	if entry.cancelled() {
 		// Cancelled
 		return false
-	} else if expiration < t.currentTime+t.tickMs {
+	} else if expiration < t.currentTime+t.tick {
 		// Already expired
 		return false
 	} else if expiration < t.currentTime+t.interval {
 		// Put in its own bucket
-		virtualId := (expiration - t.currentTime) / t.tickMs
-		bucket := t.buckets[int64(virtualId)%int64(t.wheelSize)]
+		// 桶的超时时间是按刻度对齐的绝对时间，与时间轮的currentTime是否及时推进无关
+		virtualId := expiration / t.tick
+		bucket := t.buckets[virtualId%int64(t.wheelSize)]
 		bucket.add(entry)
-		// 设置延时队列对象的超时时间，用当前添加对象的时间作为超时时间
-		if !bucket.setExpiration(unit.HiResClockMs() + virtualId*t.tickMs) {
+		// 设置延时队列对象的超时时间
+		if !bucket.setExpiration(virtualId * t.tick) {
 			// The bucket needs to be enqueued because it was an expired bucket
 			// We only need to enqueue the bucket when its expiration time has changed, i.e. the wheel has advanced
 			// and the previous buckets gets reused; further calls to set the expiration within the same wheel cycle
 			// will pass in the same value and hence return false, thus the bucket with the same expiration will not
 			// be enqueued multiple times.
-			// 插入延时队列
-			t.q.Offer(bucket)
+			// 插入延时队列，时间轮的延时队列不限容量，TryOffer不会阻塞
+			t.q.TryOffer(bucket)
 		}
 		return true
 	} else {
 		// Out of the interval. Put it into the parent timer
 		// 如果超过当前圈时间跨度，则将该任务插入下一圈中
-		if t.overflowWheel == nil {
-			t.addOverflowWheel()
-		}
-		return t.overflowWheel.add(entry)
+		return t.getOverflowWheel().add(entry)
 	}
 }
 
 // Try to advance the clock
 //推进时间轮的当前时间
-func (t *TimingWheel) advanceClock(timeMs int64) {
-	if timeMs >= t.currentTime+t.tickMs {
-		t.currentTime = timeMs - (timeMs % t.tickMs)
+func (t *TimingWheel) advanceClock(now int64) {
+	if now >= t.currentTime+t.tick {
+		t.currentTime = now - (now % t.tick)
 		// Try to advance the clock of the overflow wheel if present
 		if t.overflowWheel != nil {
 			t.overflowWheel.advanceClock(t.currentTime)
 		}
 	}
 }
+
+//清空各圈中的所有任务，返回被移除的任务，用于关闭定时器
+func (t *TimingWheel) flush() []*TaskEntry {
+	var entries []*TaskEntry
+	for w := t; w != nil; w = w.overflowWheel {
+		for _, bucket := range w.buckets {
+			entries = append(entries, bucket.flush()...)
+		}
+	}
+	return entries
+}